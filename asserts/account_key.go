@@ -31,6 +31,11 @@ type AccountKey struct {
 	since  time.Time
 	until  time.Time
 	pubKey PublicKey
+
+	// delegation constraints, unconstrained if unset
+	constraintTypes []string
+	constraintSince time.Time
+	constraintUntil time.Time
 }
 
 // AccountID returns the account-id of this account-key.
@@ -63,9 +68,77 @@ func (ak *AccountKey) isKeyValidAt(when time.Time) bool {
 	return (when.After(ak.since) || when.Equal(ak.since)) && when.Before(ak.until)
 }
 
-// publicKey returns the underlying public key of the account key.
-func (ak *AccountKey) publicKey() PublicKey {
-	return ak.pubKey
+// PublicKey returns the public key of the account key, as carried in
+// the assertion body. It can be used to verify the signatures made
+// with the corresponding private key.
+func (ak *AccountKey) PublicKey() (PublicKey, error) {
+	if ak.pubKey == nil {
+		return nil, fmt.Errorf("account-key assertion for %q does not carry a public key", ak.AccountID())
+	}
+	return ak.pubKey, nil
+}
+
+// ConstraintTypes returns the names of the assertion types the account
+// key is delegated to sign, nil if it is not restricted to any.
+func (ak *AccountKey) ConstraintTypes() []string {
+	return ak.constraintTypes
+}
+
+// CheckDelegation checks that the delegation constraints carried by the
+// signing account key, if any, permit it to sign assertions of
+// childType at the given time.
+func CheckDelegation(signingKey *AccountKey, childType *AssertionType, at time.Time) error {
+	if signingKey.constraintTypes != nil {
+		allowed := false
+		for _, name := range signingKey.constraintTypes {
+			if name == childType.Name {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("account-key %q is not delegated to sign %q assertions", signingKey.PublicKeyID(), childType.Name)
+		}
+	}
+	if !signingKey.constraintSince.IsZero() && at.Before(signingKey.constraintSince) {
+		return fmt.Errorf("account-key %q delegation is not yet valid at %s", signingKey.PublicKeyID(), at.Format(time.RFC3339))
+	}
+	if !signingKey.constraintUntil.IsZero() && !at.Before(signingKey.constraintUntil) {
+		return fmt.Errorf("account-key %q delegation has expired at %s", signingKey.PublicKeyID(), at.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ValidateTrustedKeys checks that keys, meant to be used as the
+// trusted root keys for verification, are all well-formed account-key
+// assertions carrying a public key that matches their public-key-id
+// and that are valid at the time now. It reports the first invalid
+// one.
+func ValidateTrustedKeys(keys []Assertion, now time.Time) error {
+	for _, key := range keys {
+		accKey, ok := key.(*AccountKey)
+		if !ok {
+			return fmt.Errorf("trusted key is not an account-key assertion: %s", key.Type().Name)
+		}
+		pubKey, err := accKey.PublicKey()
+		if err != nil {
+			return fmt.Errorf("invalid trusted key: %v", err)
+		}
+		if keyID := accKey.Header("public-key-id"); keyID != pubKey.ID() {
+			return fmt.Errorf("invalid trusted key for %q: public key does not match its key id %q", accKey.AccountID(), keyID)
+		}
+		if !accKey.isKeyValidAt(now) {
+			return fmt.Errorf("invalid trusted key for %q: %q is not valid at %s", accKey.AccountID(), pubKey.ID(), now.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func checkOptionalRFC3339Date(headers map[string]string, name string) (time.Time, error) {
+	if _, ok := headers[name]; !ok {
+		return time.Time{}, nil
+	}
+	return checkRFC3339Date(headers, name)
 }
 
 func checkPublicKey(ab *assertionBase, fingerprintName, keyIDName string) (PublicKey, error) {
@@ -110,6 +183,10 @@ func (ak *AccountKey) checkConsistency(db RODatabase, acck *AccountKey) error {
 // sanity
 var _ consistencyChecker = (*AccountKey)(nil)
 
+func (ak *AccountKey) prerequisites() []Ref {
+	return []Ref{{Type: AccountType, PrimaryKey: []string{ak.AccountID()}}}
+}
+
 func assembleAccountKey(assert assertionBase) (Assertion, error) {
 	since, err := checkRFC3339Date(assert.headers, "since")
 	if err != nil {
@@ -126,11 +203,37 @@ func assembleAccountKey(assert assertionBase) (Assertion, error) {
 	if err != nil {
 		return nil, err
 	}
+	var constraintTypes []string
+	if _, ok := assert.headers["constraint-types"]; ok {
+		constraintTypes, err = checkCommaSepList(assert.headers, "constraint-types")
+		if err != nil {
+			return nil, err
+		}
+		// an empty list delegates no type at all
+		if constraintTypes == nil {
+			constraintTypes = []string{}
+		}
+	}
+	constraintSince, err := checkOptionalRFC3339Date(assert.headers, "constraint-since")
+	if err != nil {
+		return nil, err
+	}
+	constraintUntil, err := checkOptionalRFC3339Date(assert.headers, "constraint-until")
+	if err != nil {
+		return nil, err
+	}
+	if !constraintSince.IsZero() && !constraintUntil.IsZero() && !constraintUntil.After(constraintSince) {
+		return nil, fmt.Errorf("invalid 'constraint-since' and 'constraint-until' times (no gap after 'constraint-since' till 'constraint-until')")
+	}
 	// ignore extra headers for future compatibility
 	return &AccountKey{
 		assertionBase: assert,
 		since:         since,
 		until:         until,
 		pubKey:        pubk,
+
+		constraintTypes: constraintTypes,
+		constraintSince: constraintSince,
+		constraintUntil: constraintUntil,
 	}, nil
 }
@@ -341,3 +341,241 @@ func (aks *accountKeySuite) TestPublicKeyIsValidAt(c *C) {
 	c.Check(asserts.AccountKeyIsKeyValidAt(accKey, aks.until.AddDate(0, -1, 0)), Equals, true)
 	c.Check(asserts.AccountKeyIsKeyValidAt(accKey, aks.until.AddDate(0, 1, 0)), Equals, false)
 }
+
+func (aks *accountKeySuite) TestPublicKeyVerifies(c *C) {
+	trustedKey := testPrivKey0
+
+	headers := map[string]string{
+		"authority-id":           "canonical",
+		"account-id":             "acc-id1",
+		"public-key-id":          aks.keyid,
+		"public-key-fingerprint": aks.fp,
+		"since":                  aks.since.Format(time.RFC3339),
+		"until":                  aks.until.Format(time.RFC3339),
+	}
+	signed, err := asserts.AssembleAndSignInTest(asserts.AccountKeyType, headers, []byte(aks.pubKeyBody), trustedKey)
+	c.Assert(err, IsNil)
+
+	a, err := asserts.Decode(asserts.Encode(signed))
+	c.Assert(err, IsNil)
+	accKey := a.(*asserts.AccountKey)
+
+	pubKey, err := accKey.PublicKey()
+	c.Assert(err, IsNil)
+	c.Check(pubKey.ID(), Equals, aks.keyid)
+	c.Check(pubKey.Fingerprint(), Equals, aks.fp)
+
+	childHeaders := map[string]string{
+		"authority-id": "acc-id1",
+		"primary-key":  "abc",
+	}
+	child, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, childHeaders, nil, testPrivKey1)
+	c.Assert(err, IsNil)
+
+	err = asserts.VerifyWithPublicKey(child, pubKey)
+	c.Check(err, IsNil)
+
+	// signed by another key
+	child, err = asserts.AssembleAndSignInTest(asserts.TestOnlyType, childHeaders, nil, testPrivKey2)
+	c.Assert(err, IsNil)
+
+	err = asserts.VerifyWithPublicKey(child, pubKey)
+	c.Check(err, NotNil)
+}
+
+func (aks *accountKeySuite) TestValidateTrustedKeys(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	keys := []asserts.Assertion{
+		store.TrustedKey,
+		asserts.BootstrapAccountKeyForTest("other", testPrivKey2.PublicKey()),
+	}
+	c.Check(asserts.ValidateTrustedKeys(keys, time.Now()), IsNil)
+
+	// not yet valid
+	c.Check(asserts.ValidateTrustedKeys(keys, store.TrustedKey.Since().AddDate(0, 0, -1)), ErrorMatches, `invalid trusted key for "canonical": ".*" is not valid at .*`)
+}
+
+func (aks *accountKeySuite) TestValidateTrustedKeysExpired(c *C) {
+	expired := asserts.ExpiredAccountKeyForTest("canonical", testPrivKey0.PublicKey())
+	keys := []asserts.Assertion{
+		asserts.BootstrapAccountKeyForTest("other", testPrivKey2.PublicKey()),
+		expired,
+	}
+	err := asserts.ValidateTrustedKeys(keys, time.Now())
+	c.Check(err, ErrorMatches, fmt.Sprintf(`invalid trusted key for "canonical": %q is not valid at .*`, expired.PublicKeyID()))
+}
+
+func (aks *accountKeySuite) TestValidateTrustedKeysNotAccountKey(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	err := asserts.ValidateTrustedKeys([]asserts.Assertion{store.TrustedAccount}, time.Now())
+	c.Check(err, ErrorMatches, "trusted key is not an account-key assertion: account")
+
+	var noPubKey asserts.AccountKey
+	err = asserts.ValidateTrustedKeys([]asserts.Assertion{&noPubKey}, time.Now())
+	c.Check(err, ErrorMatches, `invalid trusted key: account-key assertion for "" does not carry a public key`)
+}
+
+func (aks *accountKeySuite) TestPublicKeyMissing(c *C) {
+	var accKey asserts.AccountKey
+	_, err := accKey.PublicKey()
+	c.Check(err, ErrorMatches, `account-key assertion for "" does not carry a public key`)
+}
+
+func (aks *accountKeySuite) TestDecodeConstraints(c *C) {
+	constraintSince := aks.since.AddDate(0, 1, 0)
+	constraintUntil := aks.since.AddDate(0, 2, 0)
+	encoded := "type: account-key\n" +
+		"authority-id: canonical\n" +
+		"account-id: acc-id1\n" +
+		"public-key-id: " + aks.keyid + "\n" +
+		"public-key-fingerprint: " + aks.fp + "\n" +
+		aks.sinceLine +
+		aks.untilLine +
+		"constraint-types: snap-declaration, snap-revision\n" +
+		"constraint-since: " + constraintSince.Format(time.RFC3339) + "\n" +
+		"constraint-until: " + constraintUntil.Format(time.RFC3339) + "\n" +
+		fmt.Sprintf("body-length: %v", len(aks.pubKeyBody)) + "\n\n" +
+		aks.pubKeyBody + "\n\n" +
+		"openpgp c2ln"
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	accKey := a.(*asserts.AccountKey)
+	c.Check(accKey.ConstraintTypes(), DeepEquals, []string{"snap-declaration", "snap-revision"})
+
+	within := constraintSince.AddDate(0, 0, 1)
+	// permitted
+	c.Check(asserts.CheckDelegation(accKey, asserts.SnapDeclarationType, within), IsNil)
+	c.Check(asserts.CheckDelegation(accKey, asserts.SnapRevisionType, within), IsNil)
+	// forbidden type
+	err = asserts.CheckDelegation(accKey, asserts.AccountType, within)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`account-key %q is not delegated to sign "account" assertions`, aks.keyid))
+	// outside of the delegation window
+	err = asserts.CheckDelegation(accKey, asserts.SnapDeclarationType, aks.since)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`account-key %q delegation is not yet valid at .*`, aks.keyid))
+	err = asserts.CheckDelegation(accKey, asserts.SnapDeclarationType, constraintUntil)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`account-key %q delegation has expired at .*`, aks.keyid))
+}
+
+func (aks *accountKeySuite) TestDecodeNoConstraints(c *C) {
+	encoded := "type: account-key\n" +
+		"authority-id: canonical\n" +
+		"account-id: acc-id1\n" +
+		"public-key-id: " + aks.keyid + "\n" +
+		"public-key-fingerprint: " + aks.fp + "\n" +
+		aks.sinceLine +
+		aks.untilLine +
+		fmt.Sprintf("body-length: %v", len(aks.pubKeyBody)) + "\n\n" +
+		aks.pubKeyBody + "\n\n" +
+		"openpgp c2ln"
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	accKey := a.(*asserts.AccountKey)
+	c.Check(accKey.ConstraintTypes(), IsNil)
+	c.Check(asserts.CheckDelegation(accKey, asserts.AccountType, aks.since), IsNil)
+}
+
+func (aks *accountKeySuite) TestDecodeInvalidConstraints(c *C) {
+	encoded := "type: account-key\n" +
+		"authority-id: canonical\n" +
+		"account-id: acc-id1\n" +
+		"public-key-id: " + aks.keyid + "\n" +
+		"public-key-fingerprint: " + aks.fp + "\n" +
+		aks.sinceLine +
+		aks.untilLine +
+		"constraint-types: snap-declaration\n" +
+		"constraint-since: " + aks.since.Format(time.RFC3339) + "\n" +
+		"constraint-until: " + aks.until.Format(time.RFC3339) + "\n" +
+		fmt.Sprintf("body-length: %v", len(aks.pubKeyBody)) + "\n\n" +
+		aks.pubKeyBody + "\n\n" +
+		"openpgp c2ln"
+
+	invalidHeaderTests := []struct{ original, invalid, expectedErr string }{
+		{"constraint-types: snap-declaration\n", "constraint-types: snap-declaration,,model\n", `empty entry in comma separated "constraint-types" header: .*`},
+		{"constraint-since: " + aks.since.Format(time.RFC3339) + "\n", "constraint-since: 12:30\n", `"constraint-since" header is not a RFC3339 date: .*`},
+		{"constraint-until: " + aks.until.Format(time.RFC3339) + "\n", "constraint-until: \n", `"constraint-until" header should not be empty`},
+		{"constraint-until: " + aks.until.Format(time.RFC3339) + "\n", "constraint-until: " + aks.since.Format(time.RFC3339) + "\n", `invalid 'constraint-since' and 'constraint-until' times \(no gap after 'constraint-since' till 'constraint-until'\)`},
+	}
+
+	for _, test := range invalidHeaderTests {
+		invalid := strings.Replace(encoded, test.original, test.invalid, 1)
+		_, err := asserts.Decode([]byte(invalid))
+		c.Check(err, ErrorMatches, accKeyErrPrefix+test.expectedErr)
+	}
+}
+
+func (aks *accountKeySuite) TestDelegationCheckedByDatabase(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        store.Trusted,
+	})
+	c.Assert(err, IsNil)
+
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, map[string]string{
+		"constraint-types": "test-only-2",
+	}, testPrivKey2.PublicKey(), "")
+	for _, a := range []asserts.Assertion{store.StoreAccountKey(""), acct, accKey} {
+		err := db.Add(a)
+		c.Assert(err, IsNil)
+	}
+
+	devDB := assertstest.NewSigningDB(acct.AccountID(), testPrivKey2)
+
+	permitted, err := devDB.Sign(asserts.TestOnly2Type, map[string]string{
+		"pk1": "a",
+		"pk2": "b",
+	}, nil, "")
+	c.Assert(err, IsNil)
+	c.Check(db.Check(permitted), IsNil)
+
+	forbidden, err := devDB.Sign(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	}, nil, "")
+	c.Assert(err, IsNil)
+	c.Check(db.Check(forbidden), ErrorMatches, fmt.Sprintf(`account-key %q is not delegated to sign "test-only" assertions`, accKey.PublicKeyID()))
+}
+
+func (aks *accountKeySuite) TestDelegationCheckedAtTimestampHeader(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        store.Trusted,
+	})
+	c.Assert(err, IsNil)
+
+	now := time.Now()
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, map[string]string{
+		"since":            now.Add(-48 * time.Hour).Format(time.RFC3339),
+		"constraint-types": "test-only-2",
+		"constraint-since": now.Add(-48 * time.Hour).Format(time.RFC3339),
+		"constraint-until": now.Add(-24 * time.Hour).Format(time.RFC3339),
+	}, testPrivKey2.PublicKey(), "")
+	for _, a := range []asserts.Assertion{store.StoreAccountKey(""), acct, accKey} {
+		err := db.Add(a)
+		c.Assert(err, IsNil)
+	}
+
+	devDB := assertstest.NewSigningDB(acct.AccountID(), testPrivKey2)
+
+	// both the key validity and the delegation are checked at the
+	// time of the "timestamp" header
+	within, err := devDB.Sign(asserts.TestOnly2Type, map[string]string{
+		"pk1":       "a",
+		"pk2":       "b",
+		"timestamp": now.Add(-36 * time.Hour).Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+	c.Check(db.Check(within), IsNil)
+
+	after, err := devDB.Sign(asserts.TestOnly2Type, map[string]string{
+		"pk1":       "a",
+		"pk2":       "b",
+		"timestamp": now.Add(-12 * time.Hour).Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+	c.Check(db.Check(after), ErrorMatches, fmt.Sprintf(`account-key %q delegation has expired at .*`, accKey.PublicKeyID()))
+}
@@ -22,12 +22,17 @@ package asserts
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -38,19 +43,99 @@ type AssertionType struct {
 	// PrimaryKey holds the names of the headers that constitute the
 	// unique primary key for this assertion type.
 	PrimaryKey []string
+	// MaxBodySize if set (> 0) is the maximum body size for this
+	// assertion type, it is enforced in addition to the global
+	// MaxBodySize.
+	MaxBodySize int
 
 	assembler func(assert assertionBase) (Assertion, error)
+	// headerFormats maps header names to the validators of their
+	// values if present
+	headerFormats map[string]func(value string) error
+	// headerOrder optionally lists headers to emit, when signing,
+	// right after the mandatory and primary key ones, before the
+	// others in lexicographic order
+	headerOrder []string
+	// requiredHeaders and optionalHeaders list the headers, besides
+	// authority-id and the primary key ones, that the assembler
+	// requires and the ones it optionally understands
+	requiredHeaders []string
+	optionalHeaders []string
+	// lowercasePrimaryKey lists the primary key headers whose values
+	// are expected to be in normalized lowercase
+	lowercasePrimaryKey []string
 }
 
 // Understood assertion types.
 var (
-	AccountType         = &AssertionType{"account", []string{"account-id"}, assembleAccount}
-	AccountKeyType      = &AssertionType{"account-key", []string{"account-id", "public-key-id"}, assembleAccountKey}
-	ModelType           = &AssertionType{"model", []string{"series", "brand-id", "model"}, assembleModel}
-	SerialType          = &AssertionType{"serial", []string{"brand-id", "model", "serial"}, assembleSerial}
-	SnapDeclarationType = &AssertionType{"snap-declaration", []string{"series", "snap-id"}, assembleSnapDeclaration}
-	SnapBuildType       = &AssertionType{"snap-build", []string{"series", "snap-id", "snap-digest"}, assembleSnapBuild}
-	SnapRevisionType    = &AssertionType{"snap-revision", []string{"series", "snap-id", "snap-digest"}, assembleSnapRevision}
+	AccountType = &AssertionType{
+		Name:       "account",
+		PrimaryKey: []string{"account-id"},
+		assembler:  assembleAccount,
+
+		requiredHeaders:     []string{"display-name", "validation", "timestamp"},
+		optionalHeaders:     []string{"username"},
+		lowercasePrimaryKey: []string{"account-id"},
+	}
+	AccountKeyType = &AssertionType{
+		Name:       "account-key",
+		PrimaryKey: []string{"account-id", "public-key-id"},
+		assembler:  assembleAccountKey,
+
+		requiredHeaders:     []string{"public-key-fingerprint", "since", "until"},
+		optionalHeaders:     []string{"constraint-types", "constraint-since", "constraint-until"},
+		lowercasePrimaryKey: []string{"account-id"},
+	}
+	ModelType = &AssertionType{
+		Name:          "model",
+		PrimaryKey:    []string{"series", "brand-id", "model"},
+		assembler:     assembleModel,
+		headerFormats: seriesHeaderFormats,
+
+		requiredHeaders:     []string{"core", "architecture", "gadget", "kernel", "store", "class", "allowed-modes", "required-snaps", "timestamp"},
+		lowercasePrimaryKey: []string{"brand-id"},
+	}
+	SerialType = &AssertionType{
+		Name:       "serial",
+		PrimaryKey: []string{"brand-id", "model", "serial"},
+		assembler:  assembleSerial,
+
+		requiredHeaders:     []string{"device-key", "timestamp"},
+		lowercasePrimaryKey: []string{"brand-id"},
+	}
+	SnapDeclarationType = &AssertionType{
+		Name:          "snap-declaration",
+		PrimaryKey:    []string{"series", "snap-id"},
+		assembler:     assembleSnapDeclaration,
+		headerFormats: snapHeaderFormats,
+
+		requiredHeaders: []string{"snap-name", "publisher-id", "gates", "timestamp"},
+	}
+	SnapBuildType = &AssertionType{
+		Name:          "snap-build",
+		PrimaryKey:    []string{"series", "snap-id", "snap-digest"},
+		assembler:     assembleSnapBuild,
+		headerFormats: snapHeaderFormats,
+
+		requiredHeaders: []string{"grade", "snap-size", "timestamp"},
+	}
+	SnapRevisionType = &AssertionType{
+		Name:          "snap-revision",
+		PrimaryKey:    []string{"series", "snap-id", "snap-digest"},
+		assembler:     assembleSnapRevision,
+		headerFormats: snapHeaderFormats,
+
+		requiredHeaders: []string{"snap-size", "snap-revision", "developer-id", "timestamp"},
+	}
+
+	DeviceSessionRequestType = &AssertionType{
+		Name:       "device-session-request",
+		PrimaryKey: []string{"brand-id", "model", "serial"},
+		assembler:  assembleDeviceSessionRequest,
+
+		requiredHeaders:     []string{"nonce", "timestamp"},
+		lowercasePrimaryKey: []string{"brand-id"},
+	}
 
 // ...
 )
@@ -63,6 +148,44 @@ var typeRegistry = map[string]*AssertionType{
 	SnapDeclarationType.Name: SnapDeclarationType,
 	SnapBuildType.Name:       SnapBuildType,
 	SnapRevisionType.Name:    SnapRevisionType,
+
+	DeviceSessionRequestType.Name: DeviceSessionRequestType,
+}
+
+// CheckRegistry checks that the registered assertion types are
+// internally consistent: each one has a non-empty name, matching the
+// one it is registered under and so unique, at least one primary key header and an
+// assembler.
+func CheckRegistry() error {
+	return checkRegistry(typeRegistry)
+}
+
+func checkRegistry(registry map[string]*AssertionType) error {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		assertType := registry[name]
+		if assertType == nil {
+			return fmt.Errorf("assertion type registered as %q is nil", name)
+		}
+		if assertType.Name == "" {
+			return fmt.Errorf("assertion type registered as %q has an empty name", name)
+		}
+		if assertType.Name != name {
+			return fmt.Errorf("assertion type %q is registered as %q", assertType.Name, name)
+		}
+		if len(assertType.PrimaryKey) == 0 {
+			return fmt.Errorf("assertion type %q has no primary key headers", name)
+		}
+		if assertType.assembler == nil {
+			return fmt.Errorf("assertion type %q has no assembler", name)
+		}
+	}
+	return nil
 }
 
 // Type returns the AssertionType with name or nil
@@ -70,6 +193,20 @@ func Type(name string) *AssertionType {
 	return typeRegistry[name]
 }
 
+// RequiredHeaders returns the names of the headers that must be
+// provided to sign an assertion of the type: authority-id, the primary
+// key headers and any other mandatory ones.
+func (at *AssertionType) RequiredHeaders() []string {
+	required := append([]string{"authority-id"}, at.PrimaryKey...)
+	return append(required, at.requiredHeaders...)
+}
+
+// OptionalHeaders returns the names of the headers that can optionally
+// be provided to sign an assertion of the type.
+func (at *AssertionType) OptionalHeaders() []string {
+	return append([]string{"revision"}, at.optionalHeaders...)
+}
+
 // Assertion represents an assertion through its general elements.
 type Assertion interface {
 	// Type returns the type of this assertion
@@ -90,6 +227,111 @@ type Assertion interface {
 
 	// Signature returns the signed content and its unprocessed signature
 	Signature() (content, signature []byte)
+
+	// SignedContent returns the exact signed content
+	SignedContent() []byte
+
+	// Ref returns a reference to this assertion
+	Ref() Ref
+}
+
+// Ref expresses a reference to an assertion through its type and the
+// values of its primary key headers.
+type Ref struct {
+	Type       *AssertionType
+	PrimaryKey []string
+}
+
+// Unique returns a string identifying the referenced assertion, as
+// primary key values cannot contain '/' it joins them with it. It can
+// be used as map key, e.g. to deduplicate assertions.
+func (ref Ref) Unique() string {
+	return ref.Type.Name + "/" + strings.Join(ref.PrimaryKey, "/")
+}
+
+// CompareRefs compares two references for a canonical ordering of
+// assertions: first by type name then lexicographically by primary key
+// values. It returns -1, 0 or 1 if a is respectively ordered before,
+// the same as or after b.
+func CompareRefs(a, b Ref) int {
+	if a.Type.Name != b.Type.Name {
+		if a.Type.Name < b.Type.Name {
+			return -1
+		}
+		return 1
+	}
+	for i := 0; i < len(a.PrimaryKey) && i < len(b.PrimaryKey); i++ {
+		if a.PrimaryKey[i] != b.PrimaryKey[i] {
+			if a.PrimaryKey[i] < b.PrimaryKey[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a.PrimaryKey) < len(b.PrimaryKey):
+		return -1
+	case len(a.PrimaryKey) > len(b.PrimaryKey):
+		return 1
+	}
+	return 0
+}
+
+// AnyRevision can be used as the Revision of a RevisionedRef to not
+// pin any revision.
+const AnyRevision = -1
+
+// RevisionedRef expresses a reference to an assertion optionally
+// pinned to a specific revision of it.
+type RevisionedRef struct {
+	Ref
+	// Revision is the referenced revision, or AnyRevision
+	Revision int
+}
+
+// AssertionSummary is a compact description of an assertion, carrying
+// only its identity, revision and authority, suitable for listings.
+type AssertionSummary struct {
+	Type        string   `json:"type"`
+	PrimaryKey  []string `json:"primary-key"`
+	Revision    int      `json:"revision"`
+	AuthorityID string   `json:"authority-id"`
+}
+
+// Summary returns the summary of the assertion.
+func Summary(assert Assertion) AssertionSummary {
+	ref := assert.Ref()
+	return AssertionSummary{
+		Type:        ref.Type.Name,
+		PrimaryKey:  ref.PrimaryKey,
+		Revision:    assert.Revision(),
+		AuthorityID: assert.AuthorityID(),
+	}
+}
+
+// Timestamp returns the time carried by the "timestamp" header of the
+// assertion, as used by many types for when they were issued, parsed
+// as RFC3339. It errors if the header is missing or invalid.
+func Timestamp(assert Assertion) (time.Time, error) {
+	timestamp, err := checkRFC3339Date(assert.Headers(), "timestamp")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("assertion %s: %v", assert.Type().Name, err)
+	}
+	return timestamp, nil
+}
+
+// NestedAssertion decodes the body of assert as an assertion, for
+// assertions embedding another one, which they must declare with a
+// "body-format: assertion" header.
+func NestedAssertion(assert Assertion) (Assertion, error) {
+	if assert.Header("body-format") != "assertion" {
+		return nil, fmt.Errorf("assertion %s does not declare a nested assertion as body", assert.Type().Name)
+	}
+	nested, err := Decode(assert.Body())
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode nested assertion: %v", err)
+	}
+	return nested, nil
 }
 
 // MediaType is the media type for encoded assertions on the wire.
@@ -105,6 +347,66 @@ type assertionBase struct {
 	content []byte
 	// unprocessed signature
 	signature []byte
+	// pool buffer backing content and body, if borrowed
+	borrowed *bytes.Buffer
+	pool     *sync.Pool
+}
+
+func (ab *assertionBase) borrow(buf *bytes.Buffer, pool *sync.Pool) {
+	ab.borrowed = buf
+	ab.pool = pool
+}
+
+func (ab *assertionBase) borrowing() bool {
+	return ab.borrowed != nil
+}
+
+func (ab *assertionBase) release() {
+	if ab.borrowed == nil {
+		return
+	}
+	ab.pool.Put(ab.borrowed)
+	ab.borrowed = nil
+	ab.pool = nil
+	ab.content = nil
+	ab.body = nil
+}
+
+type borrower interface {
+	borrow(buf *bytes.Buffer, pool *sync.Pool)
+	borrowing() bool
+	release()
+}
+
+// ReleaseAssertion hands back the buffer backing the content of an
+// assertion decoded by a Decoder set up with SetBufferPool to its
+// pool. The assertion must not be used anymore afterwards. It does
+// nothing for assertions that do not borrow their backing bytes.
+func ReleaseAssertion(assert Assertion) {
+	if b, ok := assert.(borrower); ok {
+		b.release()
+	}
+}
+
+// ownedAssertion returns assert itself unless it borrows its backing
+// bytes from a pool, in which case it returns an equivalent assertion
+// owning copies of them, that can be kept after assert is released.
+func ownedAssertion(assert Assertion) (Assertion, error) {
+	if b, ok := assert.(borrower); !ok || !b.borrowing() {
+		return assert, nil
+	}
+	content, signature := assert.Signature()
+	ownedContent := make([]byte, len(content))
+	copy(ownedContent, content)
+	ownedSignature := make([]byte, len(signature))
+	copy(ownedSignature, signature)
+	var ownedBody []byte
+	if body := assert.Body(); len(body) > 0 {
+		// the body is the tail of the content
+		ownedBody = ownedContent[len(content)-len(body):]
+	}
+	// keep opaque assertions of unknown types as such
+	return assemble(assert.Headers(), ownedBody, ownedContent, ownedSignature, true)
 }
 
 // Type returns the assertion type.
@@ -146,23 +448,164 @@ func (ab *assertionBase) Signature() (content, signature []byte) {
 	return ab.content, ab.signature
 }
 
+// SignedContent returns the exact signed content.
+func (ab *assertionBase) SignedContent() []byte {
+	return ab.content
+}
+
+// selfCheck re-derives the headers, revision and body from the
+// preserved content and checks that they match the parsed ones held
+// by the assertion, as a safety net against encode/decode bugs.
+func (ab *assertionBase) selfCheck() error {
+	head := ab.content
+	var body []byte
+	if len(ab.body) > 0 {
+		idx := bytes.Index(ab.content, nlnl)
+		if idx == -1 {
+			return fmt.Errorf("assertion content is missing the headers/body separator")
+		}
+		head = ab.content[:idx]
+		body = ab.content[idx+len(nlnl):]
+	}
+	headers, err := parseHeaders(head)
+	if err != nil {
+		return fmt.Errorf("assertion content headers do not parse: %v", err)
+	}
+	if !reflect.DeepEqual(headers, ab.headers) {
+		return fmt.Errorf("assertion headers do not match its content")
+	}
+	revision, err := checkRevision(headers)
+	if err != nil || revision != ab.revision {
+		return fmt.Errorf("assertion revision does not match its content")
+	}
+	if !bytes.Equal(body, ab.body) {
+		return fmt.Errorf("assertion body does not match its content")
+	}
+	return nil
+}
+
+// Ref returns a reference to the assertion.
+func (ab *assertionBase) Ref() Ref {
+	assertType := ab.Type()
+	primKey := make([]string, len(assertType.PrimaryKey))
+	for i, name := range assertType.PrimaryKey {
+		primKey[i] = ab.headers[name]
+	}
+	return Ref{Type: assertType, PrimaryKey: primKey}
+}
+
 // sanity check
 var _ Assertion = (*assertionBase)(nil)
 
+// HeaderDiff returns the headers that differ between the two
+// assertions mapped to their respective values in a and b. A header
+// present in only one of them is reported with an empty value for the
+// other one. Bodies and signatures are not compared.
+func HeaderDiff(a, b Assertion) map[string][2]string {
+	diff := make(map[string][2]string)
+	aHeaders := a.Headers()
+	bHeaders := b.Headers()
+	for name, aValue := range aHeaders {
+		bValue, ok := bHeaders[name]
+		if !ok || aValue != bValue {
+			diff[name] = [2]string{aValue, bValue}
+		}
+	}
+	for name, bValue := range bHeaders {
+		if _, ok := aHeaders[name]; !ok {
+			diff[name] = [2]string{"", bValue}
+		}
+	}
+	return diff
+}
+
+// EqualIgnoringRevision returns whether the two assertions have the
+// same type, primary key, headers and body, disregarding their
+// revisions and signatures. It tells a pure revision bump apart from
+// an actual change of content.
+func EqualIgnoringRevision(a, b Assertion) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	for name := range HeaderDiff(a, b) {
+		if name != "revision" {
+			return false
+		}
+	}
+	return bytes.Equal(a.Body(), b.Body())
+}
+
 var (
 	nl   = []byte("\n")
 	nlnl = []byte("\n\n")
+	crlf = []byte("\r\n")
+
+	errCRLFBody = errors.New("assertion body contains CRLF line endings")
+
+	// UTF-8 byte order mark, as prepended to files by some editors
+	utf8BOM = []byte("\xef\xbb\xbf")
 
 	// for basic sanity checking of header names
 	headerNameSanity = regexp.MustCompile("^[a-z][a-z0-9-]*[a-z0-9]$")
 )
 
+// ParseDraftHeaders parses the header block of a hand-authored
+// assertion draft, as the headers to pass to Database.Sign. If
+// allowComments is true lines starting with '#' are ignored, so that
+// authors can annotate drafts, otherwise they are rejected as with
+// any assertion. Comments are never part of the parsed headers and so
+// cannot affect the signed content.
+func ParseDraftHeaders(draft []byte, allowComments bool) (map[string]string, error) {
+	return parseHeadersWithComments(bytes.TrimRight(draft, "\n"), allowComments)
+}
+
 func parseHeaders(head []byte) (map[string]string, error) {
+	return parseHeadersWithComments(head, false)
+}
+
+// isHeaderEntryStart returns whether line looks like the start of a
+// header entry, i.e. it has a header name accepted by namePolicy
+// followed by ':'.
+func isHeaderEntryStart(line string, namePolicy *regexp.Regexp) bool {
+	nameValueSplit := strings.Index(line, ":")
+	return nameValueSplit != -1 && namePolicy.MatchString(line[:nameValueSplit])
+}
+
+func parseHeadersWithComments(head []byte, allowComments bool) (map[string]string, error) {
+	hp := &headerParser{
+		allowComments: allowComments,
+		namePolicy:    headerNameSanity,
+		maxValueSize:  MaxHeaderValueSize,
+	}
+	return hp.parse(head)
+}
+
+// headerParser holds the rules for parsing a header block.
+type headerParser struct {
+	allowComments bool
+	namePolicy    *regexp.Regexp
+	maxValueSize  int
+	// observe, if set, is called with each parsed header in order
+	observe func(name, value string)
+}
+
+func (hp *headerParser) parse(head []byte) (map[string]string, error) {
 	if !utf8.Valid(head) {
 		return nil, fmt.Errorf("header is not utf8")
 	}
 	headers := make(map[string]string)
 	lines := strings.Split(string(head), "\n")
+	if hp.allowComments {
+		// strip comments upfront, they can be interspersed even
+		// with the lines of multiline values
+		kept := lines[:0]
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "#") {
+				kept = append(kept, line)
+			}
+		}
+		lines = kept
+	}
 	for i := 0; i < len(lines); {
 		entry := lines[i]
 		i++
@@ -171,13 +614,15 @@ func parseHeaders(head []byte) (map[string]string, error) {
 			return nil, fmt.Errorf("header entry missing ':' separator: %q", entry)
 		}
 		name := entry[:nameValueSplit]
-		if !headerNameSanity.MatchString(name) {
+		if !hp.namePolicy.MatchString(name) {
 			return nil, fmt.Errorf("invalid header name: %q", name)
 		}
 
 		afterSplit := nameValueSplit + 1
 		if afterSplit == len(entry) {
-			// multiline value
+			// multiline value: every continuation line starts with
+			// exactly one space that is dropped, the remainder,
+			// possibly empty or with further spaces, is preserved
 			size := 0
 			j := i
 			for j < len(lines) {
@@ -191,6 +636,16 @@ func parseHeaders(head []byte) (map[string]string, error) {
 			if j == i {
 				return nil, fmt.Errorf("empty multiline header value: %q", entry)
 			}
+			// a line ending the value must start the next header
+			if j < len(lines) && !isHeaderEntryStart(lines[j], hp.namePolicy) {
+				return nil, fmt.Errorf("multiline header value %q has a continuation line without leading space: %q", name, lines[j])
+			}
+
+			// the value drops the leading spaces but gains the
+			// newlines between lines
+			if size-1 > hp.maxValueSize {
+				return nil, fmt.Errorf("header %q value exceeds maximum size of %d bytes", name, hp.maxValueSize)
+			}
 
 			valueBuf := bytes.NewBuffer(make([]byte, 0, size-1))
 			valueBuf.WriteString(lines[i][1:])
@@ -201,7 +656,11 @@ func parseHeaders(head []byte) (map[string]string, error) {
 				i++
 			}
 
-			headers[name] = valueBuf.String()
+			value := valueBuf.String()
+			if hp.observe != nil {
+				hp.observe(name, value)
+			}
+			headers[name] = value
 			continue
 		}
 
@@ -209,7 +668,14 @@ func parseHeaders(head []byte) (map[string]string, error) {
 			return nil, fmt.Errorf("header entry should have a space or newline (multiline) before value: %q", entry)
 		}
 
-		headers[name] = entry[afterSplit+1:]
+		value := entry[afterSplit+1:]
+		if len(value) > hp.maxValueSize {
+			return nil, fmt.Errorf("header %q value exceeds maximum size of %d bytes", name, hp.maxValueSize)
+		}
+		if hp.observe != nil {
+			hp.observe(name, value)
+		}
+		headers[name] = value
 	}
 	return headers, nil
 }
@@ -250,10 +716,18 @@ func parseHeaders(head []byte) (map[string]string, error) {
 //
 // Typically list values in headers are expected to be comma separated.
 // Times are expected to be in the RFC3339 format: "2006-01-02T15:04:05Z07:00".
+//
+// As with a Decoder by default, a BODY containing CRLF line endings is
+// rejected.
 func Decode(serializedAssertion []byte) (Assertion, error) {
+	return decode(serializedAssertion, false)
+}
+
+func decode(serializedAssertion []byte, opaqueUnknown bool) (Assertion, error) {
 	// copy to get an independent backstorage that can't be mutated later
 	assertionSnapshot := make([]byte, len(serializedAssertion))
 	copy(assertionSnapshot, serializedAssertion)
+	assertionSnapshot = bytes.TrimPrefix(assertionSnapshot, utf8BOM)
 	contentSignatureSplit := bytes.LastIndex(assertionSnapshot, nlnl)
 	if contentSignatureSplit == -1 {
 		return nil, fmt.Errorf("assertion content/signature separator not found")
@@ -272,13 +746,16 @@ func Decode(serializedAssertion []byte) (Assertion, error) {
 		}
 		head = content[:headersBodySplit]
 	}
+	if bytes.Contains(body, crlf) {
+		return nil, errCRLFBody
+	}
 
 	headers, err := parseHeaders(head)
 	if err != nil {
 		return nil, fmt.Errorf("parsing assertion headers: %v", err)
 	}
 
-	return Assemble(headers, body, content, signature)
+	return assemble(headers, body, content, signature, opaqueUnknown)
 }
 
 // Maximum assertion component sizes.
@@ -286,29 +763,390 @@ const (
 	MaxBodySize      = 2 * 1024 * 1024
 	MaxHeadersSize   = 128 * 1024
 	MaxSignatureSize = 128 * 1024
+
+	// MaxHeaderValueSize is the default maximum size of a single
+	// header value.
+	MaxHeaderValueSize = 64 * 1024
 )
 
+// DecodeString parses a serialized assertion held in a string, it
+// behaves like Decode.
+func DecodeString(serializedAssertion string) (Assertion, error) {
+	return Decode([]byte(serializedAssertion))
+}
+
+// DecodeHeaders reads from r only the headers of a serialized
+// assertion, returning them together with its type. The body and
+// signature are left unread in r, which is read a byte at a time and
+// so should be buffered if that matters.
+func DecodeHeaders(r io.Reader) (map[string]string, *AssertionType, error) {
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, nlnl) {
+		if len(head) > MaxHeadersSize {
+			return nil, nil, fmt.Errorf("assertion headers exceed maximum size")
+		}
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF && len(head) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		head = append(head, b[0])
+	}
+
+	headers, err := parseHeaders(head[:len(head)-len(nlnl)])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing assertion headers: %v", err)
+	}
+	typ, err := checkNotEmpty(headers, "type")
+	if err != nil {
+		return nil, nil, fmt.Errorf("assertion: %v", err)
+	}
+	assertType := Type(typ)
+	if assertType == nil {
+		return nil, nil, fmt.Errorf("unknown assertion type: %q", typ)
+	}
+	return headers, assertType, nil
+}
+
 // Decoder parses a stream of assertions bundled by separating them with double newlines.
 type Decoder struct {
 	rd             io.Reader
 	initialBufSize int
 	b              *bufio.Reader
+	bufSize        int
+	rebuffers      int
+	readAhead      int
 	err            error
 	maxHeadersSize int
 	maxBodySize    int
 	maxSigSize     int
+
+	maxHeaderValueSize int
+
+	observeSizes    func(DecodedSizes)
+	bodyLineEndings BodyLineEndings
+
+	maxStreamBytes int
+	consumed       int
+
+	bufferPool *sync.Pool
+
+	timeout time.Duration
+	timed   *deadlineReader
+
+	opaqueUnknown bool
+
+	requireRevision bool
+
+	maxClockSkew time.Duration
+
+	minRevision func(ref Ref) int
+
+	// whether a leading byte order mark was looked for
+	bomChecked bool
+
+	allowedTypes   map[string]bool
+	skipDisallowed bool
+
+	headerNamePolicy *regexp.Regexp
+	observeHeader    func(name, value string)
+
+	stats DecoderStats
+}
+
+// DecoderStats holds cumulative statistics about the assertions
+// returned by a Decoder.
+type DecoderStats struct {
+	// Decoded is the number of assertions successfully decoded.
+	Decoded int
+	// Bytes is the number of bytes consumed from the stream.
+	Bytes int
+	// Types maps assertion type names to the number of decoded
+	// assertions of that type.
+	Types map[string]int
+	// Errors is the number of decoding errors, not counting io.EOF.
+	Errors int
+}
+
+// Stats returns a snapshot of the cumulative statistics of the
+// Decoder.
+func (d *Decoder) Stats() DecoderStats {
+	stats := d.stats
+	stats.Bytes = d.consumed
+	stats.Types = make(map[string]int, len(d.stats.Types))
+	for name, n := range d.stats.Types {
+		stats.Types[name] = n
+	}
+	return stats
+}
+
+// DecodedSizes holds the sizes of the components of an assertion
+// decoded by a Decoder.
+type DecodedSizes struct {
+	// Type is the name of the assertion type.
+	Type      string
+	Headers   int
+	Body      int
+	Signature int
+}
+
+// SetSizesObserver sets a function that gets invoked after each
+// successful Decode with the sizes of the components of the decoded
+// assertion.
+func (d *Decoder) SetSizesObserver(observe func(DecodedSizes)) {
+	d.observeSizes = observe
+}
+
+// BodyLineEndings controls how a Decoder treats CRLF line endings in
+// assertion bodies.
+type BodyLineEndings int
+
+const (
+	// RejectCRLFBodies makes decoding fail for assertions with a
+	// body containing CRLF line endings, this is the default.
+	RejectCRLFBodies BodyLineEndings = iota
+	// NormalizeCRLFBodies converts CRLF line endings in bodies to
+	// LF adjusting body-length accordingly. This changes the
+	// content of the assertions and thus invalidates their
+	// signatures.
+	NormalizeCRLFBodies
+)
+
+// SetBodyLineEndings sets how the Decoder treats CRLF line endings in
+// assertion bodies. With NormalizeCRLFBodies the assertions with such
+// bodies are returned with rewritten content that their signatures do
+// not cover: they will fail any signature check, e.g. Database.Check,
+// and are only suitable to be inspected or signed again, e.g. through
+// PrepareForSigning.
+func (d *Decoder) SetBodyLineEndings(mode BodyLineEndings) {
+	d.bodyLineEndings = mode
+}
+
+// ErrMaxStreamBytesExceeded is returned by Decoder.Decode once the
+// total bytes read from the stream exceed the limit set with
+// SetMaxStreamBytes.
+var ErrMaxStreamBytesExceeded = errors.New("maximum assertion stream size exceeded")
+
+// SetMaxStreamBytes sets a limit to the total bytes the Decoder reads
+// across all the assertions in the stream, if set (> 0) Decode returns
+// ErrMaxStreamBytesExceeded once that is exceeded.
+func (d *Decoder) SetMaxStreamBytes(max int) {
+	d.maxStreamBytes = max
+}
+
+// SetBufferPool sets a pool of *bytes.Buffer from which Decode
+// borrows the buffers backing the content and body of the assertions
+// it returns, instead of allocating fresh ones. Such assertions do
+// not own their backing bytes: once done with one, the caller should
+// return its buffer to the pool with ReleaseAssertion, after which it
+// must not be used anymore. Database.Add keeps its own copy of a
+// borrowing assertion, so it can be released right after being added,
+// while one put directly into a Backstore or otherwise retained must
+// not be released.
+func (d *Decoder) SetBufferPool(pool *sync.Pool) {
+	d.bufferPool = pool
+}
+
+// SetOpaqueUnknownTypes sets whether assertions of unknown types are
+// decoded as opaque ones, preserving their headers, body and signature
+// for relaying, instead of making Decode fail, which is the default.
+// Their Type is made up and unregistered, they cannot be added to a
+// Database.
+func (d *Decoder) SetOpaqueUnknownTypes(opaque bool) {
+	d.opaqueUnknown = opaque
+}
+
+// SetRequireRevision sets whether the Decoder rejects assertions
+// without a revision header, which usually indicates a hand-edited
+// draft, instead of defaulting their revision to 0, which is the
+// default.
+func (d *Decoder) SetRequireRevision(required bool) {
+	d.requireRevision = required
+}
+
+// SetReadAhead sets how much room, beyond a body, the Decoder makes
+// in its buffer when growing it to read the body, so that the
+// trailer after it, the separator and the signature, can be read in
+// the same go. It defaults to the initial buffer size.
+func (d *Decoder) SetReadAhead(size int) {
+	d.readAhead = size
+}
+
+// SetMaxClockSkew makes the Decoder reject assertions with a
+// "timestamp" header more than skew in the future with respect to the
+// local clock. A zero skew, the default, disables the check.
+func (d *Decoder) SetMaxClockSkew(skew time.Duration) {
+	d.maxClockSkew = skew
+}
+
+func checkClockSkew(assert Assertion, skew time.Duration) error {
+	if assert.Header("timestamp") == "" {
+		return nil
+	}
+	timestamp, err := Timestamp(assert)
+	if err != nil {
+		return err
+	}
+	if timestamp.After(time.Now().Add(skew)) {
+		return fmt.Errorf("assertion %s: timestamp %s is too far in the future", assert.Type().Name, timestamp.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ErrAssertionTimeout is returned by Decoder.Decode when reading an
+// assertion takes longer than the timeout set with
+// SetAssertionTimeout.
+var ErrAssertionTimeout = errors.New("timed out reading assertion")
+
+// deadlineReader fails reads once its deadline, if set, has passed.
+// Reads happen in a separate goroutine so that one blocked inside the
+// underlying reader, which cannot be interrupted in general, is
+// abandoned at the deadline as well. The underlying reader is never
+// read again afterwards.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+	buf      []byte
+	timedOut bool
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if dr.timedOut {
+		return 0, ErrAssertionTimeout
+	}
+	if dr.deadline.IsZero() {
+		return dr.r.Read(p)
+	}
+	remaining := dr.deadline.Sub(time.Now())
+	if remaining <= 0 {
+		dr.timedOut = true
+		return 0, ErrAssertionTimeout
+	}
+	// the abandoned read could still write to its buffer after a
+	// timeout, so it cannot be p
+	if len(dr.buf) < len(p) {
+		dr.buf = make([]byte, len(p))
+	}
+	buf := dr.buf[:len(p)]
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := dr.r.Read(buf)
+		done <- readResult{n, err}
+	}()
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		dr.timedOut = true
+		return 0, ErrAssertionTimeout
+	}
 }
 
+func (dr *deadlineReader) setDeadline(deadline time.Time) {
+	dr.deadline = deadline
+}
+
+// SetAssertionTimeout bounds the time Decode can spend reading any one
+// assertion, if set (> 0) Decode returns ErrAssertionTimeout when that
+// is exceeded, even if a read from the underlying reader is blocked,
+// the Decoder is then unusable and the underlying reader should be
+// closed, which also ends any read left blocked. It protects from
+// streams trickling in slowly. It does not touch the read deadlines of
+// a net.Conn, which the caller can still set and which keep working as
+// documented on NewDecoder. It must be called before the first Decode.
+func (d *Decoder) SetAssertionTimeout(timeout time.Duration) {
+	d.timeout = timeout
+	if d.timed == nil {
+		d.timed = &deadlineReader{r: d.rd}
+		d.rd = d.timed
+		d.initBuffer()
+	}
+}
+
+// TypeNotAllowedError is returned by Decoder.Decode for assertions of
+// a type not allowed with SetAllowedTypes.
+type TypeNotAllowedError struct {
+	Type string
+}
+
+func (e *TypeNotAllowedError) Error() string {
+	return fmt.Sprintf("assertion type %q is not allowed", e.Type)
+}
+
+// SetAllowedTypes restricts the Decoder to assemble only assertions of
+// the named types. Assertions of other types make Decode return a
+// *TypeNotAllowedError, or are skipped if skip is true.
+func (d *Decoder) SetAllowedTypes(typeNames []string, skip bool) {
+	d.allowedTypes = make(map[string]bool, len(typeNames))
+	for _, name := range typeNames {
+		d.allowedTypes[name] = true
+	}
+	d.skipDisallowed = skip
+}
+
+// SetMaxHeaderValueSize sets the maximum size of any single header
+// value the Decoder accepts, on top of the limit on the size of the
+// whole header block. It defaults to MaxHeaderValueSize.
+func (d *Decoder) SetMaxHeaderValueSize(size int) {
+	d.maxHeaderValueSize = size
+}
+
+// SetHeaderObserver sets a function to be called with the name and
+// value of every header, in order, as it is parsed, e.g. for
+// auditing. It cannot affect the parsing. Headers are observed also
+// for assertions that turn out to be invalid afterwards.
+func (d *Decoder) SetHeaderObserver(observe func(name, value string)) {
+	d.observeHeader = observe
+}
+
+// SetHeaderNamePolicy sets the regexp that header names must match
+// for the Decoder to accept them, instead of the default strict one
+// (lowercase letters, digits and dashes, at least two characters). A
+// nil policy restores the default. This is meant for experimentation
+// with new assertion types.
+func (d *Decoder) SetHeaderNamePolicy(policy *regexp.Regexp) {
+	d.headerNamePolicy = policy
+}
+
+// SetMinRevision sets a function that Decode uses to look up the
+// minimum revision of interest for each decoded assertion identity,
+// assertions with a lower revision are skipped. This avoids further
+// processing of assertions older than the ones already held.
+func (d *Decoder) SetMinRevision(minRevision func(ref Ref) int) {
+	d.minRevision = minRevision
+}
+
+var bodyLengthHeader = regexp.MustCompile(`(?m)^body-length: [0-9]+$`)
+
 // initBuffer finishes a Decoder initialization by setting up the bufio.Reader,
 // it returns the *Decoder for convenience of notation.
 func (d *Decoder) initBuffer() *Decoder {
 	d.b = bufio.NewReaderSize(d.rd, d.initialBufSize)
+	d.bufSize = d.initialBufSize
 	return d
 }
 
 const defaultDecoderButSize = 4096
 
 // NewDecoder returns a Decoder to parse the stream of assertions from the reader.
+//
+// The Decoder reads from r only as Decode needs, so deadlines on r,
+// e.g. set with SetReadDeadline on a net.Conn, bound Decode as well:
+// when one expires Decode fails with an error that is still a
+// net.Error, whatever part of an assertion was being read, and can be
+// checked with its Timeout. Read errors are sticky, the Decoder is
+// unusable afterwards.
 func NewDecoder(r io.Reader) *Decoder {
 	return (&Decoder{
 		rd:             r,
@@ -316,18 +1154,51 @@ func NewDecoder(r io.Reader) *Decoder {
 		maxHeadersSize: MaxHeadersSize,
 		maxBodySize:    MaxBodySize,
 		maxSigSize:     MaxSignatureSize,
+
+		maxHeaderValueSize: MaxHeaderValueSize,
 	}).initBuffer()
 }
 
+// grow replaces the buffer with one of the given size, carrying over
+// what is currently buffered.
+func (d *Decoder) grow(size int) {
+	rebuf, reerr := d.b.Peek(d.b.Buffered())
+	if reerr != nil {
+		panic(reerr)
+	}
+	mr := io.MultiReader(bytes.NewBuffer(rebuf), d.rd)
+	d.b = bufio.NewReaderSize(mr, size)
+	d.bufSize = size
+	d.rebuffers++
+}
+
+// growForBody grows the buffer ahead of reading a body of the given
+// length, so that it holds it together with the trailer after it.
+// The buffer is grown proportionally to the length, up to the
+// maximum body size, to spare rebuffering for following bodies of
+// similar or somewhat bigger sizes.
+func (d *Decoder) growForBody(length int) {
+	readAhead := d.readAhead
+	if readAhead == 0 {
+		readAhead = d.initialBufSize
+	}
+	if length+readAhead <= d.bufSize {
+		return
+	}
+	size := 2 * length
+	if size > d.maxBodySize {
+		size = d.maxBodySize
+	}
+	if size < length {
+		size = length
+	}
+	d.grow(size + readAhead)
+}
+
 func (d *Decoder) peek(size int) ([]byte, error) {
 	buf, err := d.b.Peek(size)
 	if err == bufio.ErrBufferFull {
-		rebuf, reerr := d.b.Peek(d.b.Buffered())
-		if reerr != nil {
-			panic(reerr)
-		}
-		mr := io.MultiReader(bytes.NewBuffer(rebuf), d.rd)
-		d.b = bufio.NewReaderSize(mr, (size/d.initialBufSize+1)*d.initialBufSize)
+		d.grow((size/d.initialBufSize + 1) * d.initialBufSize)
 		buf, err = d.b.Peek(size)
 	}
 	if err != nil && d.err == nil {
@@ -336,12 +1207,39 @@ func (d *Decoder) peek(size int) ([]byte, error) {
 	return buf, d.err
 }
 
+// discard consumes size bytes from the buffer accounting for them
+// against the stream size limit.
+func (d *Decoder) discard(size int) error {
+	d.b.Discard(size)
+	d.consumed += size
+	return d.checkStreamBytes()
+}
+
+// skipBOM discards a byte order mark at the start of the stream.
+func (d *Decoder) skipBOM() error {
+	// a short stream is dealt with by the actual decoding
+	start, _ := d.b.Peek(len(utf8BOM))
+	if !bytes.Equal(start, utf8BOM) {
+		return nil
+	}
+	return d.discard(len(utf8BOM))
+}
+
+func (d *Decoder) checkStreamBytes() error {
+	if d.maxStreamBytes > 0 && d.consumed > d.maxStreamBytes {
+		return ErrMaxStreamBytesExceeded
+	}
+	return nil
+}
+
 // NB: readExact and readUntil use peek underneath and their returned
 // buffers are valid only until the next reading call
 
 func (d *Decoder) readExact(size int) ([]byte, error) {
 	buf, err := d.peek(size)
-	d.b.Discard(len(buf))
+	if err := d.discard(len(buf)); err != nil {
+		return nil, err
+	}
 	if len(buf) == size {
 		return buf, nil
 	}
@@ -357,12 +1255,16 @@ func (d *Decoder) readUntil(delim []byte, maxSize int) ([]byte, error) {
 	for {
 		buf, err := d.peek(size)
 		if i := bytes.Index(buf[last:], delim); i >= 0 {
-			d.b.Discard(last + i + len(delim))
+			if err := d.discard(last + i + len(delim)); err != nil {
+				return nil, err
+			}
 			return buf[:last+i+len(delim)], nil
 		}
 		// report errors only once we have consumed what is buffered
 		if err != nil && len(buf) == d.b.Buffered() {
-			d.b.Discard(len(buf))
+			if err := d.discard(len(buf)); err != nil {
+				return nil, err
+			}
 			return buf, err
 		}
 		last = size - len(delim) + 1
@@ -376,50 +1278,230 @@ func (d *Decoder) readUntil(delim []byte, maxSize int) ([]byte, error) {
 // Decode parses the next assertion from the stream.
 // It returns the error io.EOF at the end of a well-formed stream.
 func (d *Decoder) Decode() (Assertion, error) {
+	assert, err := d.decodeFiltered()
+	switch {
+	case err == io.EOF:
+	case err != nil:
+		d.stats.Errors++
+	default:
+		d.stats.Decoded++
+		if d.stats.Types == nil {
+			d.stats.Types = make(map[string]int)
+		}
+		d.stats.Types[assert.Type().Name]++
+	}
+	return assert, err
+}
+
+func (d *Decoder) decodeFiltered() (Assertion, error) {
+	for {
+		assert, err := d.decodeNext()
+		if _, ok := err.(*TypeNotAllowedError); ok && d.skipDisallowed {
+			continue
+		}
+		if err != nil || d.minRevision == nil {
+			return assert, err
+		}
+		if assert.Revision() >= d.minRevision(assert.Ref()) {
+			return assert, nil
+		}
+		// too old, skip it
+		ReleaseAssertion(assert)
+	}
+}
+
+func (d *Decoder) decodeNext() (Assertion, error) {
+	if err := d.checkStreamBytes(); err != nil {
+		return nil, err
+	}
+	if d.timeout > 0 {
+		d.timed.setDeadline(time.Now().Add(d.timeout))
+		defer d.timed.setDeadline(time.Time{})
+	}
+	assert, err := d.decode()
+	if err := d.checkStreamBytes(); err != nil {
+		return nil, err
+	}
+	if err != nil && d.err == ErrAssertionTimeout {
+		return nil, ErrAssertionTimeout
+	}
+	return assert, err
+}
+
+// netReadError wraps a net.Error met reading the stream, keeping it
+// a net.Error, e.g. for callers to check for timeouts.
+type netReadError struct {
+	what string
+	err  net.Error
+}
+
+func (e *netReadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.what, e.err)
+}
+
+func (e *netReadError) Timeout() bool {
+	return e.err.Timeout()
+}
+
+func (e *netReadError) Temporary() bool {
+	return e.err.Temporary()
+}
+
+// readError qualifies an error met reading the stream with what was
+// being read.
+func readError(what string, err error) error {
+	if netErr, ok := err.(net.Error); ok {
+		return &netReadError{what: what, err: netErr}
+	}
+	return fmt.Errorf("%s: %v", what, err)
+}
+
+// readHeaders reads and parses the headers of the next assertion,
+// returning them together with the raw headers and the nlnl separator
+// after them.
+func (d *Decoder) readHeaders() ([]byte, map[string]string, error) {
+	if !d.bomChecked {
+		d.bomChecked = true
+		if err := d.skipBOM(); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// read the headers and the nlnl separator after them
 	headAndSep, err := d.readUntil(nlnl, d.maxHeadersSize)
 	if err != nil {
 		if err == io.EOF {
 			if len(headAndSep) != 0 {
-				return nil, io.ErrUnexpectedEOF
+				return nil, nil, io.ErrUnexpectedEOF
 			}
-			return nil, io.EOF
+			return nil, nil, io.EOF
 		}
-		return nil, fmt.Errorf("error reading assertion headers: %v", err)
+		return nil, nil, readError("error reading assertion headers", err)
 	}
 
-	headLen := len(headAndSep) - len(nlnl)
-	headers, err := parseHeaders(headAndSep[:headLen])
+	hp := &headerParser{
+		namePolicy:   d.headerNamePolicy,
+		maxValueSize: d.maxHeaderValueSize,
+		observe:      d.observeHeader,
+	}
+	if hp.namePolicy == nil {
+		hp.namePolicy = headerNameSanity
+	}
+	headers, err := hp.parse(headAndSep[:len(headAndSep)-len(nlnl)])
 	if err != nil {
-		return nil, fmt.Errorf("parsing assertion headers: %v", err)
+		return nil, nil, fmt.Errorf("parsing assertion headers: %v", err)
+	}
+	return headAndSep, headers, nil
+}
+
+// skipHeaders reads the next assertion returning only its headers,
+// its body and signature are skipped without being copied or
+// checked beyond what is needed to find the start of the following
+// assertion.
+func (d *Decoder) skipHeaders() (map[string]string, error) {
+	_, headers, err := d.readHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := checkBodyLength(headers)
+	if err != nil {
+		return nil, fmt.Errorf("assertion: %v", err)
+	}
+	if length > d.maxBodySize {
+		return nil, fmt.Errorf("assertion body length %d exceeds maximum body size", length)
+	}
+	if length > 0 {
+		if _, err := d.readExact(length); err != nil {
+			return nil, err
+		}
+	}
+
+	endOfBody, err := d.readUntil(nlnl, d.maxSigSize)
+	if err != nil && err != io.EOF {
+		return nil, readError("error reading assertion trailer", err)
+	}
+	if bytes.Equal(endOfBody, nlnl) {
+		_, err = d.readUntil(nlnl, d.maxSigSize)
+		if err != nil && err != io.EOF {
+			return nil, readError("error reading assertion signature", err)
+		}
+	} else if length > 0 {
+		return nil, fmt.Errorf("missing content/signature separator")
+	}
+	return headers, nil
+}
+
+func (d *Decoder) decode() (Assertion, error) {
+	headAndSep, headers, err := d.readHeaders()
+	if err != nil {
+		return nil, err
 	}
+	headLen := len(headAndSep) - len(nlnl)
 
-	length, err := checkInteger(headers, "body-length", 0)
+	length, err := checkBodyLength(headers)
 	if err != nil {
 		return nil, fmt.Errorf("assertion: %v", err)
 	}
+	if d.requireRevision {
+		if _, err := checkRevisionWith(headers, true); err != nil {
+			return nil, fmt.Errorf("assertion: %v", err)
+		}
+	}
 	if length > d.maxBodySize {
 		return nil, fmt.Errorf("assertion body length %d exceeds maximum body size", length)
 	}
+	if typ := Type(headers["type"]); typ != nil {
+		// check the type specific limit before reading the body
+		if err := checkBodySize(typ, length); err != nil {
+			return nil, err
+		}
+	}
 
 	// save the headers before we try to read more, and setup to capture
 	// the whole content in a buffer
-	contentBuf := bytes.NewBuffer(make([]byte, 0, len(headAndSep)+length))
+	var contentBuf *bytes.Buffer
+	if d.bufferPool != nil {
+		contentBuf = d.bufferPool.Get().(*bytes.Buffer)
+		contentBuf.Reset()
+		contentBuf.Grow(len(headAndSep) + length)
+		defer func() {
+			// give back the buffer unless the assertion borrows it
+			if contentBuf != nil {
+				d.bufferPool.Put(contentBuf)
+			}
+		}()
+	} else {
+		contentBuf = bytes.NewBuffer(make([]byte, 0, len(headAndSep)+length))
+	}
 	contentBuf.Write(headAndSep)
 
 	if length > 0 {
 		// read the body if length != 0
+		d.growForBody(length)
 		body, err := d.readExact(length)
 		if err != nil {
 			return nil, err
 		}
+		if bytes.Contains(body, crlf) {
+			if d.bodyLineEndings != NormalizeCRLFBodies {
+				return nil, errCRLFBody
+			}
+			body = bytes.Replace(body, crlf, nl, -1)
+			length = len(body)
+			headers["body-length"] = strconv.Itoa(length)
+			headAndSep = bodyLengthHeader.ReplaceAll(headAndSep, []byte("body-length: "+headers["body-length"]))
+			headLen = len(headAndSep) - len(nlnl)
+			contentBuf.Reset()
+			contentBuf.Write(headAndSep)
+		}
 		contentBuf.Write(body)
 	}
 
 	// try to read the end of body a.k.a content/signature separator
 	endOfBody, err := d.readUntil(nlnl, d.maxSigSize)
 	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("error reading assertion trailer: %v", err)
+		return nil, readError("error reading assertion trailer", err)
 	}
 
 	var sig []byte
@@ -427,7 +1509,7 @@ func (d *Decoder) Decode() (Assertion, error) {
 		// we got the nlnl content/signature separator, read the signature now and the assertion/assertion nlnl separation
 		sig, err = d.readUntil(nlnl, d.maxSigSize)
 		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("error reading assertion signature: %v", err)
+			return nil, readError("error reading assertion signature", err)
 		}
 	} else {
 		// we got the signature directly which is a ok format only if body length == 0
@@ -452,10 +1534,174 @@ func (d *Decoder) Decode() (Assertion, error) {
 	finalSig := make([]byte, len(sig))
 	copy(finalSig, sig)
 
-	return Assemble(headers, finalBody, finalContent, finalSig)
+	if d.allowedTypes != nil && !d.allowedTypes[headers["type"]] {
+		return nil, &TypeNotAllowedError{Type: headers["type"]}
+	}
+
+	assert, err := assemble(headers, finalBody, finalContent, finalSig, d.opaqueUnknown)
+	if err != nil {
+		return nil, err
+	}
+	if d.maxClockSkew != 0 {
+		if err := checkClockSkew(assert, d.maxClockSkew); err != nil {
+			return nil, err
+		}
+	}
+	if d.bufferPool != nil {
+		if b, ok := assert.(borrower); ok {
+			b.borrow(contentBuf, d.bufferPool)
+			contentBuf = nil
+		}
+	}
+
+	if d.observeSizes != nil {
+		d.observeSizes(DecodedSizes{
+			Type:      assert.Type().Name,
+			Headers:   headLen,
+			Body:      len(finalBody),
+			Signature: len(finalSig),
+		})
+	}
+
+	return assert, nil
+}
+
+// multiStream concatenates assertion streams inserting separators
+// between them as needed.
+type multiStream struct {
+	readers []io.Reader
+	// whether the next non-empty read starts a new source
+	atBoundary bool
+	// number of consecutive newlines at the end of the output so far
+	trailingNLs int
+	emitted     bool
+	pending     []byte
+}
+
+// MultiStream returns a reader yielding the concatenation of the
+// given streams of assertions, inserting between them the separators
+// required for a Decoder to read the result correctly.
+func MultiStream(readers ...io.Reader) io.Reader {
+	r := make([]io.Reader, len(readers))
+	copy(r, readers)
+	return &multiStream{readers: r}
+}
+
+func (ms *multiStream) emit(p, data []byte) int {
+	n := copy(p, data)
+	if n == 0 {
+		return 0
+	}
+	ms.emitted = true
+	i := n
+	for i > 0 && p[i-1] == '\n' {
+		i--
+	}
+	if i == 0 {
+		ms.trailingNLs += n
+	} else {
+		ms.trailingNLs = n - i
+	}
+	return n
+}
+
+func (ms *multiStream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if len(ms.pending) != 0 {
+			n := ms.emit(p, ms.pending)
+			ms.pending = ms.pending[n:]
+			return n, nil
+		}
+		if len(ms.readers) == 0 {
+			return 0, io.EOF
+		}
+		n, err := ms.readers[0].Read(p)
+		if n > 0 {
+			if ms.atBoundary && ms.emitted && ms.trailingNLs < 2 {
+				sep := nlnl[ms.trailingNLs:]
+				ms.pending = make([]byte, 0, len(sep)+n)
+				ms.pending = append(ms.pending, sep...)
+				ms.pending = append(ms.pending, p[:n]...)
+				ms.atBoundary = false
+				continue
+			}
+			ms.atBoundary = false
+			n = ms.emit(p, p[:n])
+		}
+		if err == io.EOF {
+			ms.readers = ms.readers[1:]
+			ms.atBoundary = true
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Authorities decodes the stream of assertions from r and returns the
+// sorted set of the distinct authority-ids that signed them.
+// The signatures are not verified.
+func Authorities(r io.Reader) ([]string, error) {
+	d := NewDecoder(r)
+	seen := make(map[string]bool)
+	var authorities []string
+	for {
+		a, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		authorityID := a.AuthorityID()
+		if !seen[authorityID] {
+			seen[authorityID] = true
+			authorities = append(authorities, authorityID)
+		}
+	}
+	sort.Strings(authorities)
+	return authorities, nil
+}
+
+// TypeHistogram returns how many assertions of each type, by type
+// name, the stream from r holds. Only the headers of the assertions
+// are parsed, so this is cheap and works also for types unknown to
+// this version but it doesn't imply the assertions are valid.
+func TypeHistogram(r io.Reader) (map[string]int, error) {
+	d := NewDecoder(r)
+	hist := make(map[string]int)
+	for {
+		headers, err := d.skipHeaders()
+		if err == io.EOF {
+			return hist, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		typ, err := checkNotEmpty(headers, "type")
+		if err != nil {
+			return nil, fmt.Errorf("assertion: %v", err)
+		}
+		hist[typ]++
+	}
 }
 
 func checkRevision(headers map[string]string) (int, error) {
+	return checkRevisionWith(headers, false)
+}
+
+// checkRevisionWith checks the revision header, if required is true
+// it must be present instead of defaulting to 0.
+func checkRevisionWith(headers map[string]string, required bool) (int, error) {
+	if required {
+		if _, err := checkExists(headers, "revision"); err != nil {
+			return -1, err
+		}
+	}
 	revision, err := checkInteger(headers, "revision", 0)
 	if err != nil {
 		return -1, err
@@ -466,17 +1712,52 @@ func checkRevision(headers map[string]string) (int, error) {
 	return revision, nil
 }
 
-// Assemble assembles an assertion from its components.
+// Assemble assembles an assertion from its components. An empty body,
+// nil or not, is normalized to nil, so that Body() consistently
+// returns nil for assertions without a body.
 func Assemble(headers map[string]string, body, content, signature []byte) (Assertion, error) {
-	length, err := checkInteger(headers, "body-length", 0)
+	return assemble(headers, body, content, signature, false)
+}
+
+// opaqueAssertion holds an assertion of an unknown type, preserving
+// its headers, body and signature so that it can be relayed.
+type opaqueAssertion struct {
+	assertionBase
+	assertType *AssertionType
+}
+
+// Type returns the unregistered assertion type made up for the
+// assertion, it has no primary key.
+func (opq *opaqueAssertion) Type() *AssertionType {
+	return opq.assertType
+}
+
+// Ref returns a reference to the assertion, by type only.
+func (opq *opaqueAssertion) Ref() Ref {
+	return Ref{Type: opq.assertType}
+}
+
+func opaqueType(name string) *AssertionType {
+	assertType := &AssertionType{Name: name}
+	assertType.assembler = func(assert assertionBase) (Assertion, error) {
+		return &opaqueAssertion{assertionBase: assert, assertType: assertType}, nil
+	}
+	return assertType
+}
+
+func assemble(headers map[string]string, body, content, signature []byte, opaqueUnknown bool) (Assertion, error) {
+	length, err := checkBodyLength(headers)
 	if err != nil {
 		return nil, fmt.Errorf("assertion: %v", err)
 	}
 	if length != len(body) {
 		return nil, fmt.Errorf("assertion body length and declared body-length don't match: %v != %v", len(body), length)
 	}
+	if length == 0 {
+		body = nil
+	}
 
-	if _, err := checkNotEmpty(headers, "authority-id"); err != nil {
+	if _, err := checkAuthorityID(headers); err != nil {
 		return nil, fmt.Errorf("assertion: %v", err)
 	}
 
@@ -486,7 +1767,14 @@ func Assemble(headers map[string]string, body, content, signature []byte) (Asser
 	}
 	assertType := Type(typ)
 	if assertType == nil {
-		return nil, fmt.Errorf("unknown assertion type: %q", typ)
+		if !opaqueUnknown {
+			return nil, fmt.Errorf("unknown assertion type: %q", typ)
+		}
+		assertType = opaqueType(typ)
+	}
+
+	if err := checkBodySize(assertType, length); err != nil {
+		return nil, err
 	}
 
 	for _, primKey := range assertType.PrimaryKey {
@@ -495,6 +1783,10 @@ func Assemble(headers map[string]string, body, content, signature []byte) (Asser
 		}
 	}
 
+	if err := checkHeaderFormats(assertType, headers); err != nil {
+		return nil, fmt.Errorf("assertion %s: %v", assertType.Name, err)
+	}
+
 	revision, err := checkRevision(headers)
 	if err != nil {
 		return nil, fmt.Errorf("assertion: %v", err)
@@ -503,6 +1795,10 @@ func Assemble(headers map[string]string, body, content, signature []byte) (Asser
 	if len(signature) == 0 {
 		return nil, fmt.Errorf("empty assertion signature")
 	}
+	// an empty line would be taken as the end of the assertion in a stream
+	if bytes.Contains(bytes.TrimRight(signature, "\n"), nlnl) {
+		return nil, fmt.Errorf("assertion signature cannot contain empty lines")
+	}
 
 	assert, err := assertType.assembler(assertionBase{
 		headers:   headers,
@@ -517,6 +1813,18 @@ func Assemble(headers map[string]string, body, content, signature []byte) (Asser
 	return assert, nil
 }
 
+// checkBodySize checks the body length against both the global and the
+// assertion type specific maximum body sizes.
+func checkBodySize(assertType *AssertionType, length int) error {
+	if length > MaxBodySize {
+		return fmt.Errorf("assertion body length %d exceeds maximum body size", length)
+	}
+	if assertType.MaxBodySize > 0 && length > assertType.MaxBodySize {
+		return fmt.Errorf("assertion %s body length %d exceeds maximum body size for the type", assertType.Name, length)
+	}
+	return nil
+}
+
 func writeHeader(buf *bytes.Buffer, headers map[string]string, name string) {
 	buf.WriteByte('\n')
 	buf.WriteString(name)
@@ -532,30 +1840,109 @@ func writeHeader(buf *bytes.Buffer, headers map[string]string, name string) {
 }
 
 func assembleAndSign(assertType *AssertionType, headers map[string]string, body []byte, privKey PrivateKey) (Assertion, error) {
-	err := checkAssertType(assertType)
+	finalHeaders, finalBody, revision, content, err := prepareContent(assertType, headers, body)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signContent(content, privKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign assertion: %v", err)
+	}
+	// be 'cat' friendly, add a ignored newline to the signature which is the last part of the encoded assertion
+	signature = append(signature, '\n')
+
+	assert, err := assertType.assembler(assertionBase{
+		headers:   finalHeaders,
+		body:      finalBody,
+		revision:  revision,
+		content:   content,
+		signature: signature,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble assertion %s: %v", assertType.Name, err)
+	}
+	return assert, nil
+}
+
+// PrepareForSigning returns the canonical content of an assertion of
+// the given type with the given headers and body, exactly as it would
+// be signed, without needing a private key. The content can be signed
+// externally and the assertion then put together with
+// AssembleFromSignature.
+func PrepareForSigning(assertType *AssertionType, headers map[string]string, body []byte) (content []byte, err error) {
+	_, _, _, content, err = prepareContent(assertType, headers, body)
 	if err != nil {
 		return nil, err
 	}
+	return content, nil
+}
+
+// AssembleFromSignature puts together an assertion from its content,
+// as returned by PrepareForSigning, and a signature of it produced
+// externally. The headers and body are parsed back from the content.
+func AssembleFromSignature(content, signature []byte) (Assertion, error) {
+	// the signature is what follows the last empty line
+	if bytes.Contains(signature, nlnl) {
+		return nil, fmt.Errorf("assertion signature cannot contain empty lines")
+	}
+	buf := make([]byte, 0, len(content)+len(nlnl)+len(signature))
+	buf = append(buf, content...)
+	buf = append(buf, nlnl...)
+	buf = append(buf, signature...)
+	return decode(buf, false)
+}
+
+// prepareContent checks and completes headers and body for signing,
+// returning them together with the revision and the canonical content.
+func prepareContent(assertType *AssertionType, headers map[string]string, body []byte) (finalHeaders map[string]string, finalBody []byte, revision int, content []byte, err error) {
+	err = checkAssertType(assertType)
+	if err != nil {
+		return nil, nil, -1, nil, err
+	}
+
+	if typ, ok := headers["type"]; ok && typ != assertType.Name {
+		return nil, nil, -1, nil, fmt.Errorf("cannot sign assertion %s with mismatched \"type\" header: %q", assertType.Name, typ)
+	}
 
-	finalHeaders := make(map[string]string, len(headers))
+	finalHeaders = make(map[string]string, len(headers))
 	for name, value := range headers {
 		finalHeaders[name] = value
 	}
 	bodyLength := len(body)
-	finalBody := make([]byte, bodyLength)
+	if err := checkBodySize(assertType, bodyLength); err != nil {
+		return nil, nil, -1, nil, err
+	}
+	finalBody = make([]byte, bodyLength)
 	copy(finalBody, body)
 	finalHeaders["type"] = assertType.Name
 	finalHeaders["body-length"] = strconv.Itoa(bodyLength)
 
-	if _, err := checkNotEmpty(finalHeaders, "authority-id"); err != nil {
-		return nil, err
+	if _, err := checkAuthorityID(finalHeaders); err != nil {
+		return nil, nil, -1, nil, err
 	}
 
-	revision, err := checkRevision(finalHeaders)
+	revision, err = checkRevision(finalHeaders)
 	if err != nil {
-		return nil, err
+		return nil, nil, -1, nil, err
+	}
+
+	content, err = buildContent(assertType, finalHeaders, finalBody, revision)
+	if err != nil {
+		return nil, nil, -1, nil, err
+	}
+	if bodyLength == 0 {
+		finalBody = nil
 	}
+	return finalHeaders, finalBody, revision, content, nil
+}
 
+// buildContent builds the canonical content of an assertion from its
+// headers, which must include "body-length", and body. Headers that
+// are left implicit in the canonical form, a zero revision and a zero
+// body length, are deleted from finalHeaders.
+func buildContent(assertType *AssertionType, finalHeaders map[string]string, finalBody []byte, revision int) ([]byte, error) {
+	bodyLength := len(finalBody)
 	buf := bytes.NewBufferString("type: ")
 	buf.WriteString(assertType.Name)
 
@@ -579,6 +1966,18 @@ func assembleAndSign(assertType *AssertionType, headers map[string]string, body
 		written[primKey] = true
 	}
 
+	if err := checkHeaderFormats(assertType, finalHeaders); err != nil {
+		return nil, err
+	}
+
+	// emit headers in the order hinted by the type if any
+	for _, name := range assertType.headerOrder {
+		if _, ok := finalHeaders[name]; ok && !written[name] {
+			writeHeader(buf, finalHeaders, name)
+			written[name] = true
+		}
+	}
+
 	// emit other headers in lexicographic order
 	otherKeys := make([]string, 0, len(finalHeaders))
 	for name := range finalHeaders {
@@ -601,27 +2000,26 @@ func assembleAndSign(assertType *AssertionType, headers map[string]string, body
 		buf.Grow(bodyLength + 2)
 		buf.Write(nlnl)
 		buf.Write(finalBody)
-	} else {
-		finalBody = nil
 	}
-	content := buf.Bytes()
+	return buf.Bytes(), nil
+}
 
-	signature, err := signContent(content, privKey)
+// Canonicalize returns assert with its content in the canonical form,
+// with the headers in the order used when signing. As the signature
+// covers the exact content, this only succeeds, returning assert
+// itself, if its content was already canonical, otherwise an error is
+// returned as its signature cannot cover the canonical content.
+func Canonicalize(assert Assertion) (Assertion, error) {
+	content, _ := assert.Signature()
+	headers := assert.Headers()
+	body := assert.Body()
+	headers["body-length"] = strconv.Itoa(len(body))
+	canonical, err := buildContent(assert.Type(), headers, body, assert.Revision())
 	if err != nil {
-		return nil, fmt.Errorf("cannot sign assertion: %v", err)
+		return nil, fmt.Errorf("cannot canonicalize assertion: %v", err)
 	}
-	// be 'cat' friendly, add a ignored newline to the signature which is the last part of the encoded assertion
-	signature = append(signature, '\n')
-
-	assert, err := assertType.assembler(assertionBase{
-		headers:   finalHeaders,
-		body:      finalBody,
-		revision:  revision,
-		content:   content,
-		signature: signature,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("cannot assemble assertion %s: %v", assertType.Name, err)
+	if !bytes.Equal(canonical, content) {
+		return nil, fmt.Errorf("cannot canonicalize assertion: its signature does not cover the canonical form of its content")
 	}
 	return assert, nil
 }
@@ -637,17 +2035,62 @@ func Encode(assert Assertion) []byte {
 	return buf.Bytes()
 }
 
+// CheckEncodable checks that the encoding of the assertion produced by
+// Encode can be decoded back into an assertion with the same content
+// and signature. This matters for assertions not produced by Decode or
+// signing, whose content or signature could be oddly terminated.
+func CheckEncodable(assert Assertion) error {
+	_, opaque := assert.(*opaqueAssertion)
+	decoded, err := decode(Encode(assert), opaque)
+	if err != nil {
+		return fmt.Errorf("assertion cannot be decoded back from its encoding: %v", err)
+	}
+	content, signature := assert.Signature()
+	decodedContent, decodedSignature := decoded.Signature()
+	if !bytes.Equal(decodedContent, content) || !bytes.Equal(decodedSignature, signature) {
+		return fmt.Errorf("assertion content or signature is not preserved by its encoding")
+	}
+	return nil
+}
+
+// EncodedSize returns the size of the serialized assertion as returned
+// by Encode, without encoding it.
+func EncodedSize(assert Assertion) int {
+	content, signature := assert.Signature()
+	return len(content) + len(nlnl) + len(signature)
+}
+
 // Encoder emits a stream of assertions bundled by separating them with double newlines.
 type Encoder struct {
 	wr      io.Writer
+	buf     *bufio.Writer
 	nextSep []byte
 }
 
 // NewEncoder returns a Encoder to emit a stream of assertions to a writer.
+// Each assertion is emitted with a few small writes, an Encoder returned by
+// NewBufferedEncoder is preferable for unbuffered writers.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{wr: w}
 }
 
+// NewBufferedEncoder returns a Encoder to emit a stream of assertions to a
+// writer buffering its output, Flush must be called to write out any
+// remaining buffered data.
+func NewBufferedEncoder(w io.Writer) *Encoder {
+	buf := bufio.NewWriter(w)
+	return &Encoder{wr: buf, buf: buf}
+}
+
+// Flush writes any buffered data to the underlying writer, it does
+// nothing if the Encoder is not buffering.
+func (enc *Encoder) Flush() error {
+	if enc.buf == nil {
+		return nil
+	}
+	return enc.buf.Flush()
+}
+
 // append emits an already encoded assertion into the stream with a proper required separator.
 func (enc *Encoder) append(encoded []byte) error {
 	sz := len(encoded)
@@ -21,9 +21,20 @@ package asserts_test
 
 import (
 	"bytes"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"regexp"
 	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
 
+	"golang.org/x/crypto/openpgp/packet"
 	. "gopkg.in/check.v1"
 
 	"github.com/snapcore/snapd/asserts"
@@ -37,6 +48,55 @@ func (as *assertsSuite) TestType(c *C) {
 	c.Check(asserts.Type("test-only"), Equals, asserts.TestOnlyType)
 }
 
+func (as *assertsSuite) TestRequiredOptionalHeaders(c *C) {
+	c.Check(asserts.TestOnlyType.RequiredHeaders(), DeepEquals, []string{"authority-id", "primary-key"})
+	c.Check(asserts.TestOnlyType.OptionalHeaders(), DeepEquals, []string{"revision"})
+
+	c.Check(asserts.AccountType.RequiredHeaders(), DeepEquals, []string{"authority-id", "account-id", "display-name", "validation", "timestamp"})
+	c.Check(asserts.AccountType.OptionalHeaders(), DeepEquals, []string{"revision", "username"})
+
+	c.Check(asserts.SnapBuildType.RequiredHeaders(), DeepEquals, []string{"authority-id", "series", "snap-id", "snap-digest", "grade", "snap-size", "timestamp"})
+	c.Check(asserts.SnapBuildType.OptionalHeaders(), DeepEquals, []string{"revision"})
+}
+
+func (as *assertsSuite) TestSignWithRequiredHeadersOnly(c *C) {
+	pubKey := testPrivKey0.PublicKey()
+	encodedPubKey, err := asserts.EncodePublicKey(pubKey)
+	c.Assert(err, IsNil)
+
+	values := map[string]string{
+		"authority-id":           "canonical",
+		"brand-id":               "canonical",
+		"series":                 "16",
+		"timestamp":              "2016-01-01T00:00:00Z",
+		"since":                  "2016-01-01T00:00:00Z",
+		"until":                  "2030-01-01T00:00:00Z",
+		"snap-size":              "1",
+		"snap-revision":          "1",
+		"public-key-id":          pubKey.ID(),
+		"public-key-fingerprint": pubKey.Fingerprint(),
+		"device-key":             string(encodedPubKey),
+	}
+
+	for _, assertType := range asserts.RegisteredTypes() {
+		headers := make(map[string]string)
+		for _, name := range assertType.RequiredHeaders() {
+			value, ok := values[name]
+			if !ok {
+				value = "x"
+			}
+			headers[name] = value
+		}
+		var body []byte
+		if assertType == asserts.AccountKeyType {
+			body = encodedPubKey
+		}
+
+		_, err := asserts.AssembleAndSignInTest(assertType, headers, body, testPrivKey0)
+		c.Check(err, IsNil, Commentf("%s", assertType.Name))
+	}
+}
+
 func (as *assertsSuite) TestUnknown(c *C) {
 	c.Check(asserts.Type(""), IsNil)
 	c.Check(asserts.Type("unknown"), IsNil)
@@ -48,6 +108,48 @@ const exampleEmptyBodyAllDefaults = "type: test-only\n" +
 	"\n\n" +
 	"openpgp c2ln"
 
+func (as *assertsSuite) TestRefUnique(c *C) {
+	ref1 := asserts.Ref{Type: asserts.TestOnly2Type, PrimaryKey: []string{"a", "b"}}
+	ref1Again := asserts.Ref{Type: asserts.TestOnly2Type, PrimaryKey: []string{"a", "b"}}
+	c.Check(ref1.Unique(), Equals, "test-only-2/a/b")
+	c.Check(ref1Again.Unique(), Equals, ref1.Unique())
+
+	for _, other := range []asserts.Ref{
+		{Type: asserts.TestOnly2Type, PrimaryKey: []string{"b", "a"}},
+		{Type: asserts.TestOnly2Type, PrimaryKey: []string{"a", "c"}},
+		{Type: asserts.TestOnlyType, PrimaryKey: []string{"a"}},
+	} {
+		c.Check(other.Unique(), Not(Equals), ref1.Unique())
+	}
+
+	seen := map[string]bool{ref1.Unique(): true}
+	c.Check(seen[ref1Again.Unique()], Equals, true)
+}
+
+func (as *assertsSuite) TestCompareRefs(c *C) {
+	ref := func(t *asserts.AssertionType, pk ...string) asserts.Ref {
+		return asserts.Ref{Type: t, PrimaryKey: pk}
+	}
+	tests := []struct {
+		a, b asserts.Ref
+		cmp  int
+	}{
+		// same type, different keys
+		{ref(asserts.TestOnlyType, "a"), ref(asserts.TestOnlyType, "a"), 0},
+		{ref(asserts.TestOnlyType, "a"), ref(asserts.TestOnlyType, "b"), -1},
+		{ref(asserts.TestOnlyType, "b"), ref(asserts.TestOnlyType, "a"), 1},
+		{ref(asserts.TestOnly2Type, "a", "z"), ref(asserts.TestOnly2Type, "b", "a"), -1},
+		{ref(asserts.TestOnly2Type, "a", "b"), ref(asserts.TestOnly2Type, "a", "a"), 1},
+		// different types, by type name first
+		{ref(asserts.TestOnlyType, "z"), ref(asserts.TestOnly2Type, "a", "a"), -1},
+		{ref(asserts.TestOnly2Type, "a", "a"), ref(asserts.TestOnlyType, "z"), 1},
+		{ref(asserts.AccountType, "z"), ref(asserts.AccountKeyType, "a", "a"), -1},
+	}
+	for _, test := range tests {
+		c.Check(asserts.CompareRefs(test.a, test.b), Equals, test.cmp, Commentf("%v vs %v", test.a, test.b))
+	}
+}
+
 func (as *assertsSuite) TestDecodeEmptyBodyAllDefaults(c *C) {
 	a, err := asserts.Decode([]byte(exampleEmptyBodyAllDefaults))
 	c.Assert(err, IsNil)
@@ -121,6 +223,15 @@ func (as *assertsSuite) TestDecodeGetSignatureBits(c *C) {
 	c.Check(cont, DeepEquals, []byte(content))
 }
 
+func (as *assertsSuite) TestSignedContent(c *C) {
+	a, err := asserts.Decode([]byte(exampleBodyAndExtraHeaders))
+	c.Assert(err, IsNil)
+
+	content, _ := a.Signature()
+	c.Check(a.SignedContent(), DeepEquals, content)
+	c.Check(string(a.SignedContent()), Equals, exampleBodyAndExtraHeaders[:strings.LastIndex(exampleBodyAndExtraHeaders, "\n\n")])
+}
+
 func (as *assertsSuite) TestDecodeNoSignatureSplit(c *C) {
 	for _, encoded := range []string{"", "foo"} {
 		_, err := asserts.Decode([]byte(encoded))
@@ -136,6 +247,9 @@ func (as *assertsSuite) TestDecodeHeaderParsingErrors(c *C) {
 		{"foo: a\nbar:>\n\n", `header entry should have a space or newline \(multiline\) before value: "bar:>"`},
 		{"foo: a\nbar:\n\n", `empty multiline header value: "bar:"`},
 		{"foo: a\nbar:\nbaz: x\n\n", `empty multiline header value: "bar:"`},
+		{"foo: a\nbar:\n x\ny\n\n", `multiline header value "bar" has a continuation line without leading space: "y"`},
+		{"foo: a\nbar:\n x\n\ty\n\n", `multiline header value "bar" has a continuation line without leading space: "\\ty"`},
+		{"bar:\n x\ny z: 1\nfoo: a\n\n", `multiline header value "bar" has a continuation line without leading space: "y z: 1"`},
 	}
 
 	for _, test := range headerParsingErrorsTests {
@@ -144,6 +258,46 @@ func (as *assertsSuite) TestDecodeHeaderParsingErrors(c *C) {
 	}
 }
 
+func (as *assertsSuite) TestDecodeMultilineRaggedIndentation(c *C) {
+	encoded := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"multiline:\n" +
+		" a\n" +
+		"  b\n" +
+		" \n" +
+		"   c\n" +
+		"primary-key: abc" +
+		"\n\n" +
+		"openpgp c2ln"
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	// only the first space of each continuation line is dropped
+	c.Check(a.Header("multiline"), Equals, "a\n b\n\n  c")
+	c.Check(a.Header("primary-key"), Equals, "abc")
+}
+
+func (as *assertsSuite) TestDecodeWithBOM(c *C) {
+	a, err := asserts.Decode([]byte("\xef\xbb\xbf" + exampleBodyAndExtraHeaders))
+	c.Assert(err, IsNil)
+	checkContent(c, a, exampleBodyAndExtraHeaders)
+	c.Check(a.Header("authority-id"), Equals, "auth-id2")
+}
+
+func (as *assertsSuite) TestDecoderWithBOM(c *C) {
+	stream := "\xef\xbb\xbf" + exampleBodyAndExtraHeaders + "\n" + exampleEmptyBodyAllDefaults
+	decoder := asserts.NewDecoder(strings.NewReader(stream))
+	a1, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	checkContent(c, a1, exampleBodyAndExtraHeaders)
+
+	a2, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	checkContent(c, a2, exampleEmptyBodyAllDefaults)
+
+	_, err = decoder.Decode()
+	c.Check(err, Equals, io.EOF)
+}
+
 func (as *assertsSuite) TestDecodeInvalid(c *C) {
 	encoded := "type: test-only\n" +
 		"authority-id: auth-id\n" +
@@ -158,13 +312,27 @@ func (as *assertsSuite) TestDecodeInvalid(c *C) {
 	invalidAssertTests := []struct{ original, invalid, expectedErr string }{
 		{"body-length: 5", "body-length: z", `assertion: "body-length" header is not an integer: z`},
 		{"body-length: 5", "body-length: 3", "assertion body length and declared body-length don't match: 5 != 3"},
+		{"body-length: 5", "body-length: -5", `assertion: "body-length" header should not be negative: -5`},
+		{"body-length: 5", "body-length: 99999999999999999999999", `assertion: "body-length" header is out of range: 99999999999999999999999`},
+		{"body-length: 5", "body-length: 05", `assertion: "body-length" header is not an integer: 05`},
+		{"body-length: 5", "body-length: +5", `assertion: "body-length" header is not an integer: \+5`},
+		{"body-length: 5", "body-length:  5 ", `assertion: "body-length" header is not an integer:  5 `},
+		{"body-length: 5", "body-length: 5" + strings.Repeat("z", 100), `assertion: "body-length" header is not an integer: 5` + strings.Repeat("z", 63) + `\.\.\.`},
+		{"body-length: 5", "body-length: " + strings.Repeat("9", 100), `assertion: "body-length" header is out of range: ` + strings.Repeat("9", 64) + `\.\.\.`},
 		{"authority-id: auth-id\n", "", `assertion: "authority-id" header is mandatory`},
 		{"authority-id: auth-id\n", "authority-id: \n", `assertion: "authority-id" header should not be empty`},
+		{"authority-id: auth-id\n", "authority-id: auth/id\n", `assertion: "authority-id" header has invalid format: "auth/id"`},
+		{"authority-id: auth-id\n", "authority-id: -auth-id\n", `assertion: "authority-id" header has invalid format: "-auth-id"`},
 		{"openpgp c2ln", "", "empty assertion signature"},
 		{"type: test-only\n", "", `assertion: "type" header is mandatory`},
 		{"type: test-only\n", "type: unknown\n", `unknown assertion type: "unknown"`},
 		{"revision: 0\n", "revision: Z\n", `assertion: "revision" header is not an integer: Z`},
 		{"revision: 0\n", "revision: -10\n", "assertion: revision should be positive: -10"},
+		{"revision: 0\n", "revision: 00\n", `assertion: "revision" header is not an integer: 00`},
+		{"revision: 0\n", "revision: 05\n", `assertion: "revision" header is not an integer: 05`},
+		{"revision: 0\n", "revision: +5\n", `assertion: "revision" header is not an integer: \+5`},
+		{"revision: 0\n", "revision: -0\n", `assertion: "revision" header is not an integer: -0`},
+		{"revision: 0\n", "revision: 5" + strings.Repeat("ü", 40) + "\n", `assertion: "revision" header is not an integer: 5` + strings.Repeat("ü", 31) + `\.\.\.`},
 		{"primary-key: abc\n", "", `assertion test-only: "primary-key" header is mandatory`},
 		{"primary-key: abc\n", "primary-key: a/c\n", `assertion test-only: "primary-key" primary key header cannot contain '/'`},
 	}
@@ -176,6 +344,58 @@ func (as *assertsSuite) TestDecodeInvalid(c *C) {
 	}
 }
 
+func (as *assertsSuite) TestDecodeString(c *C) {
+	a, err := asserts.DecodeString(exampleBodyAndExtraHeaders)
+	c.Assert(err, IsNil)
+	expected, err := asserts.Decode([]byte(exampleBodyAndExtraHeaders))
+	c.Assert(err, IsNil)
+	c.Check(a, DeepEquals, expected)
+
+	_, err = asserts.DecodeString("type: test-only\n\nopenpgp c2ln")
+	_, expectedErr := asserts.Decode([]byte("type: test-only\n\nopenpgp c2ln"))
+	c.Assert(expectedErr, NotNil)
+	c.Check(err, DeepEquals, expectedErr)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("unexpected read")
+}
+
+func (as *assertsSuite) TestDecodeHeaders(c *C) {
+	split := strings.Index(exampleBodyAndExtraHeaders, "\n\n") + 2
+	// anything after the headers cannot be read
+	r := io.MultiReader(strings.NewReader(exampleBodyAndExtraHeaders[:split]), failingReader{})
+
+	headers, assertType, err := asserts.DecodeHeaders(r)
+	c.Assert(err, IsNil)
+	c.Check(assertType, Equals, asserts.TestOnlyType)
+	c.Check(headers, DeepEquals, map[string]string{
+		"type":         "test-only",
+		"authority-id": "auth-id2",
+		"primary-key":  "abc",
+		"revision":     "5",
+		"header1":      "value1",
+		"header2":      "value2",
+		"body-length":  "8",
+	})
+}
+
+func (as *assertsSuite) TestDecodeHeadersErrors(c *C) {
+	tests := []struct{ input, expectedErr string }{
+		{"", "EOF"},
+		{"type: test-only\n", "unexpected EOF"},
+		{"authority-id: auth-id\n\n", `assertion: "type" header is mandatory`},
+		{"type: unknown\n\n", `unknown assertion type: "unknown"`},
+		{"type test-only\n\n", `parsing assertion headers: header entry missing ':' separator: "type test-only"`},
+	}
+	for _, test := range tests {
+		_, _, err := asserts.DecodeHeaders(strings.NewReader(test.input))
+		c.Check(err, ErrorMatches, test.expectedErr)
+	}
+}
+
 func checkContent(c *C, a asserts.Assertion, encoded string) {
 	expected, err := asserts.Decode([]byte(encoded))
 	c.Assert(err, IsNil)
@@ -312,6 +532,18 @@ func (as *assertsSuite) TestDecoderBodyTooBig(c *C) {
 	c.Assert(err, ErrorMatches, "assertion body length 8 exceeds maximum body size")
 }
 
+func (as *assertsSuite) TestDecoderInvalidBodyLength(c *C) {
+	streamData := strings.Replace(exampleBodyAndExtraHeaders, "body-length: 8", "body-length: -8", 1)
+	decoder := asserts.NewDecoder(bytes.NewBufferString(streamData))
+	_, err := decoder.Decode()
+	c.Check(err, ErrorMatches, `assertion: "body-length" header should not be negative: -8`)
+
+	streamData = strings.Replace(exampleBodyAndExtraHeaders, "body-length: 8", "body-length: 99999999999999999999999", 1)
+	decoder = asserts.NewDecoder(bytes.NewBufferString(streamData))
+	_, err = decoder.Decode()
+	c.Check(err, ErrorMatches, `assertion: "body-length" header is out of range: 99999999999999999999999`)
+}
+
 func (as *assertsSuite) TestDecoderSignatureTooBig(c *C) {
 	decoder := asserts.NewDecoderStressed(bytes.NewBufferString(exampleBodyAndExtraHeaders), 4, 1024, 1024, 7)
 	_, err := decoder.Decode()
@@ -335,6 +567,217 @@ func (as *assertsSuite) TestEncode(c *C) {
 	c.Check(encodeRes, DeepEquals, encoded)
 }
 
+func (as *assertsSuite) TestEmptyBodyIsNil(c *C) {
+	a, err := asserts.Decode([]byte(exampleEmptyBodyAllDefaults))
+	c.Assert(err, IsNil)
+	c.Check(a.Body(), IsNil)
+
+	headers := map[string]string{
+		"type":         "test-only",
+		"authority-id": "auth-id1",
+		"primary-key":  "abc",
+	}
+	content, sig := a.Signature()
+	for _, body := range [][]byte{nil, {}} {
+		a, err := asserts.Assemble(headers, body, content, sig)
+		c.Assert(err, IsNil)
+		c.Check(a.Body(), IsNil)
+	}
+}
+
+func (as *assertsSuite) TestCheckEncodable(c *C) {
+	a, err := asserts.Decode([]byte(exampleBodyAndExtraHeaders))
+	c.Assert(err, IsNil)
+	c.Check(asserts.CheckEncodable(a), IsNil)
+
+	// a body ending in newlines is fine, it is delimited by body-length
+	headers := map[string]string{
+		"type":         "test-only",
+		"authority-id": "auth-id1",
+		"primary-key":  "abc",
+		"body-length":  "6",
+	}
+	content := []byte("type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"body-length: 6\n\n" +
+		"BODY\n\n")
+	a, err = asserts.Assemble(headers, []byte("BODY\n\n"), content, []byte("openpgp c2ln"))
+	c.Assert(err, IsNil)
+	c.Check(asserts.CheckEncodable(a), IsNil)
+}
+
+func (as *assertsSuite) TestCheckEncodableOddContentEnding(c *C) {
+	headers := map[string]string{
+		"type":         "test-only",
+		"authority-id": "auth-id1",
+		"primary-key":  "abc",
+	}
+	// content ending with a newline
+	content := []byte("type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n")
+	a, err := asserts.Assemble(headers, nil, content, []byte("openpgp c2ln"))
+	c.Assert(err, IsNil)
+
+	err = asserts.CheckEncodable(a)
+	c.Check(err, ErrorMatches, "assertion cannot be decoded back from its encoding: .*")
+}
+
+func (as *assertsSuite) TestCanonicalizeCanonical(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"revision":     "3",
+		"zzz":          "last",
+		"aaa":          "multi\nline",
+	}
+	signed, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("THE-BODY"), testPrivKey1)
+	c.Assert(err, IsNil)
+
+	for _, encoded := range []string{
+		string(asserts.Encode(signed)),
+		exampleEmptyBodyAllDefaults,
+	} {
+		a, err := asserts.Decode([]byte(encoded))
+		c.Assert(err, IsNil)
+
+		canon, err := asserts.Canonicalize(a)
+		c.Assert(err, IsNil)
+		c.Check(asserts.Encode(canon), DeepEquals, []byte(encoded))
+	}
+}
+
+func (as *assertsSuite) TestCanonicalizeNotCanonical(c *C) {
+	for _, encoded := range []string{
+		// headers not in canonical order
+		"type: test-only\n" +
+			"primary-key: abc\n" +
+			"authority-id: auth-id1" +
+			"\n\n" +
+			"openpgp c2ln",
+		"type: test-only\n" +
+			"authority-id: auth-id1\n" +
+			"primary-key: abc\n" +
+			"zzz: last\n" +
+			"aaa: first" +
+			"\n\n" +
+			"openpgp c2ln",
+		// implicit defaults spelled out
+		exampleEmptyBody2NlNl,
+	} {
+		a, err := asserts.Decode([]byte(encoded))
+		c.Assert(err, IsNil)
+
+		_, err = asserts.Canonicalize(a)
+		c.Check(err, ErrorMatches, "cannot canonicalize assertion: its signature does not cover the canonical form of its content")
+	}
+}
+
+// signExternally signs content with the given openpgp private key
+// packet the way an offline signer not using asserts would
+func signExternally(c *C, content []byte, privk *packet.PrivateKey) []byte {
+	sig := new(packet.Signature)
+	sig.PubKeyAlgo = privk.PubKeyAlgo
+	sig.Hash = crypto.SHA512
+	sig.CreationTime = time.Now()
+	sig.IssuerKeyId = &privk.KeyId
+	h := crypto.SHA512.New()
+	h.Write(content)
+	err := sig.Sign(h, privk, &packet.Config{DefaultHash: crypto.SHA512})
+	c.Assert(err, IsNil)
+	buf := new(bytes.Buffer)
+	err = sig.Serialize(buf)
+	c.Assert(err, IsNil)
+	return []byte("openpgp " + base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+func (as *assertsSuite) TestPrepareForSigning(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"revision":     "3",
+		"zzz":          "last",
+		"aaa":          "multi\nline",
+	}
+	body := []byte("THE-BODY")
+
+	content, err := asserts.PrepareForSigning(asserts.TestOnlyType, headers, body)
+	c.Assert(err, IsNil)
+	// headers are left untouched
+	c.Check(headers, HasLen, 5)
+
+	// the content is the one that signing would produce
+	signed, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, body, testPrivKey1)
+	c.Assert(err, IsNil)
+	c.Check(content, DeepEquals, signed.SignedContent())
+
+	// only the content and an externally produced signature are
+	// needed to put the assertion together
+	signature := signExternally(c, content, asserts.PrivateKeyPacket(testPrivKey1))
+	a, err := asserts.AssembleFromSignature(content, signature)
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.TestOnlyType)
+	c.Check(a.Revision(), Equals, 3)
+	c.Check(a.Header("aaa"), Equals, "multi\nline")
+	c.Check(a.Body(), DeepEquals, body)
+	c.Check(a.SignedContent(), DeepEquals, content)
+	c.Check(asserts.VerifyWithPublicKey(a, testPrivKey1.PublicKey()), IsNil)
+
+	// and it survives a round trip
+	decoded, err := asserts.Decode(asserts.Encode(a))
+	c.Assert(err, IsNil)
+	c.Check(decoded.SignedContent(), DeepEquals, content)
+}
+
+func (as *assertsSuite) TestAssembleFromSignatureErrors(c *C) {
+	content, err := asserts.PrepareForSigning(asserts.TestOnlyType, map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+	}, nil)
+	c.Assert(err, IsNil)
+
+	_, err = asserts.AssembleFromSignature(content, nil)
+	c.Check(err, ErrorMatches, "empty assertion signature")
+
+	_, err = asserts.AssembleFromSignature(content, []byte("openpgp c2ln\n\nmore"))
+	c.Check(err, ErrorMatches, "assertion signature cannot contain empty lines")
+}
+
+func (as *assertsSuite) TestPrepareForSigningErrors(c *C) {
+	_, err := asserts.PrepareForSigning(asserts.TestOnlyType, map[string]string{
+		"type":         "test-only-2",
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+	}, nil)
+	c.Check(err, ErrorMatches, `cannot sign assertion test-only with mismatched "type" header: "test-only-2"`)
+
+	_, err = asserts.PrepareForSigning(asserts.TestOnlyType, map[string]string{
+		"authority-id": "auth-id1",
+	}, nil)
+	c.Check(err, ErrorMatches, `"primary-key" header is mandatory`)
+}
+
+func (as *assertsSuite) TestEncodedSize(c *C) {
+	for _, encoded := range []string{
+		exampleEmptyBodyAllDefaults,
+		exampleBodyAndExtraHeaders,
+		exampleEmptyBody2NlNl,
+	} {
+		a, err := asserts.Decode([]byte(encoded))
+		c.Assert(err, IsNil)
+		c.Check(asserts.EncodedSize(a), Equals, len(asserts.Encode(a)))
+	}
+
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+	}
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("THE-BODY"), testPrivKey1)
+	c.Assert(err, IsNil)
+	c.Check(asserts.EncodedSize(a), Equals, len(asserts.Encode(a)))
+}
+
 func (as *assertsSuite) TestEncoderOK(c *C) {
 	encoded := []byte("type: test-only\n" +
 		"authority-id: auth-id2\n" +
@@ -364,6 +807,49 @@ func (as *assertsSuite) TestEncoderOK(c *C) {
 	c.Check(cont1, DeepEquals, cont0)
 }
 
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (wc *writeCounter) Write(data []byte) (int, error) {
+	wc.writes++
+	return wc.Buffer.Write(data)
+}
+
+func (as *assertsSuite) TestBufferedEncoder(c *C) {
+	encoded := []byte("type: test-only\n" +
+		"authority-id: auth-id2\n" +
+		"primary-key: xyz\n" +
+		"revision: 5\n" +
+		"body-length: 8\n\n" +
+		"THE-BODY" +
+		"\n\n" +
+		"openpgp c2ln")
+	a, err := asserts.Decode(encoded)
+	c.Assert(err, IsNil)
+
+	unbuffered := new(writeCounter)
+	enc := asserts.NewEncoder(unbuffered)
+	for i := 0; i < 10; i++ {
+		c.Assert(enc.Encode(a), IsNil)
+	}
+	// Flush is harmless if not buffering
+	c.Assert(enc.Flush(), IsNil)
+
+	buffered := new(writeCounter)
+	enc = asserts.NewBufferedEncoder(buffered)
+	for i := 0; i < 10; i++ {
+		c.Assert(enc.Encode(a), IsNil)
+	}
+	c.Check(buffered.writes, Equals, 0)
+	c.Assert(enc.Flush(), IsNil)
+
+	c.Check(buffered.writes, Equals, 1)
+	c.Check(unbuffered.writes > 10, Equals, true)
+	c.Check(buffered.Bytes(), DeepEquals, unbuffered.Bytes())
+}
+
 func (as *assertsSuite) TestEncoderSingleDecodeOK(c *C) {
 	encoded := []byte("type: test-only\n" +
 		"authority-id: auth-id2\n" +
@@ -402,6 +888,62 @@ func (as *assertsSuite) TestSignFormatSanityEmptyBody(c *C) {
 	c.Check(err, IsNil)
 }
 
+func (as *assertsSuite) TestSignInvalidAuthorityID(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth/id1",
+		"primary-key":  "0",
+	}
+	_, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey1)
+	c.Check(err, ErrorMatches, `"authority-id" header has invalid format: "auth/id1"`)
+
+	headers["authority-id"] = "Auth-id1"
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey1)
+	c.Assert(err, IsNil)
+	c.Check(a.AuthorityID(), Equals, "Auth-id1")
+}
+
+func (as *assertsSuite) TestSignMismatchedTypeHeader(c *C) {
+	headers := map[string]string{
+		"type":         "test-only-2",
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+	}
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey1)
+	c.Check(a, IsNil)
+	c.Check(err, ErrorMatches, `cannot sign assertion test-only with mismatched "type" header: "test-only-2"`)
+
+	// matching is fine
+	headers["type"] = "test-only"
+	a, err = asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey1)
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.TestOnlyType)
+}
+
+func (as *assertsSuite) TestSignHeaderOrderHint(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"beta":         "b",
+		"alpha":        "a",
+		"zeta":         "z",
+		"gamma":        "c",
+	}
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyOrderedType, headers, nil, testPrivKey1)
+	c.Assert(err, IsNil)
+
+	c.Check(string(a.SignedContent()), Equals, "type: test-only-ordered\n"+
+		"authority-id: auth-id1\n"+
+		"primary-key: 0\n"+
+		"zeta: z\n"+
+		"alpha: a\n"+
+		"beta: b\n"+
+		"gamma: c")
+
+	decoded, err := asserts.Decode(asserts.Encode(a))
+	c.Assert(err, IsNil)
+	c.Check(decoded.Headers(), DeepEquals, a.Headers())
+}
+
 func (as *assertsSuite) TestSignFormatSanityNonEmptyBody(c *C) {
 	headers := map[string]string{
 		"authority-id": "auth-id1",
@@ -518,3 +1060,1273 @@ func (as *assertsSuite) TestAssembleRoundtrip(c *C) {
 	reassembledEncoded := asserts.Encode(reassembled)
 	c.Check(reassembledEncoded, DeepEquals, encoded)
 }
+
+const exampleTypeMaxBodySize = "type: test-only-2\n" +
+	"authority-id: auth-id1\n" +
+	"pk1: a\n" +
+	"pk2: b\n" +
+	"body-length: 20\n\n" +
+	"THE-BODY-OVER-16-BYT" +
+	"\n\n" +
+	"openpgp c2ln\n"
+
+func (as *assertsSuite) TestDecodeTypeMaxBodySize(c *C) {
+	_, err := asserts.Decode([]byte(exampleTypeMaxBodySize))
+	c.Check(err, ErrorMatches, "assertion test-only-2 body length 20 exceeds maximum body size for the type")
+
+	// under the type specific limit
+	encoded := strings.Replace(exampleTypeMaxBodySize, "body-length: 20\n\nTHE-BODY-OVER-16-BYT", "body-length: 8\n\nTHE-BODY", 1)
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	c.Check(a.Body(), DeepEquals, []byte("THE-BODY"))
+}
+
+func (as *assertsSuite) TestDecoderTypeMaxBodySize(c *C) {
+	decoder := asserts.NewDecoder(bytes.NewBufferString(exampleTypeMaxBodySize))
+	_, err := decoder.Decode()
+	c.Check(err, ErrorMatches, "assertion test-only-2 body length 20 exceeds maximum body size for the type")
+}
+
+func (as *assertsSuite) TestSignTypeMaxBodySize(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"pk1":          "a",
+		"pk2":          "b",
+	}
+	_, err := asserts.AssembleAndSignInTest(asserts.TestOnly2Type, headers, []byte("THE-BODY-OVER-16-BYT"), testPrivKey1)
+	c.Check(err, ErrorMatches, "assertion test-only-2 body length 20 exceeds maximum body size for the type")
+
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnly2Type, headers, []byte("THE-BODY"), testPrivKey1)
+	c.Assert(err, IsNil)
+	c.Check(a.Body(), DeepEquals, []byte("THE-BODY"))
+}
+
+func (as *assertsSuite) TestDecoderSizesObserver(c *C) {
+	bigBody := strings.Repeat("B", 10000)
+	bigEncoded := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: big\n" +
+		"body-length: 10000\n\n" +
+		bigBody +
+		"\n\n" +
+		"openpgp c2ln\n"
+
+	stream := new(bytes.Buffer)
+	enc := asserts.NewEncoder(stream)
+	asserts.EncoderAppend(enc, []byte(exampleEmptyBodyAllDefaults))
+	asserts.EncoderAppend(enc, []byte(bigEncoded))
+
+	var observed []asserts.DecodedSizes
+	decoder := asserts.NewDecoder(stream)
+	decoder.SetSizesObserver(func(sizes asserts.DecodedSizes) {
+		observed = append(observed, sizes)
+	})
+
+	for {
+		_, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+	}
+
+	c.Check(observed, DeepEquals, []asserts.DecodedSizes{
+		{Type: "test-only", Headers: strings.Index(exampleEmptyBodyAllDefaults, "\n\n"), Body: 0, Signature: len("openpgp c2ln\n")},
+		{Type: "test-only", Headers: strings.Index(bigEncoded, "\n\n"), Body: 10000, Signature: len("openpgp c2ln\n")},
+	})
+}
+
+func (as *assertsSuite) TestDecoderStats(c *C) {
+	testOnly2Encoded := "type: test-only-2\n" +
+		"authority-id: auth-id1\n" +
+		"pk1: a\n" +
+		"pk2: b" +
+		"\n\n" +
+		"openpgp c2ln\n"
+	unknownEncoded := "type: unknown-type\n" +
+		"authority-id: auth-id1" +
+		"\n\n" +
+		"openpgp c2ln\n"
+
+	stream := new(bytes.Buffer)
+	enc := asserts.NewEncoder(stream)
+	asserts.EncoderAppend(enc, []byte(exampleEmptyBodyAllDefaults))
+	asserts.EncoderAppend(enc, []byte(testOnly2Encoded))
+	asserts.EncoderAppend(enc, []byte(unknownEncoded))
+	asserts.EncoderAppend(enc, []byte(exampleBodyAndExtraHeaders))
+	streamLen := stream.Len()
+
+	decoder := asserts.NewDecoder(stream)
+	c.Check(decoder.Stats(), DeepEquals, asserts.DecoderStats{Types: map[string]int{}})
+
+	var errs []error
+	for {
+		_, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.Assert(errs, HasLen, 1)
+	c.Check(errs[0], ErrorMatches, `unknown assertion type: "unknown-type"`)
+
+	stats := decoder.Stats()
+	c.Check(stats, DeepEquals, asserts.DecoderStats{
+		Decoded: 3,
+		Bytes:   streamLen,
+		Types: map[string]int{
+			"test-only":   2,
+			"test-only-2": 1,
+		},
+		Errors: 1,
+	})
+
+	// changing the snapshot does not affect the decoder
+	stats.Types["test-only"] = 10
+	c.Check(decoder.Stats().Types["test-only"], Equals, 2)
+}
+
+func (as *assertsSuite) TestDecoderBufferPool(c *C) {
+	allocated := 0
+	pool := &sync.Pool{New: func() interface{} {
+		allocated++
+		return new(bytes.Buffer)
+	}}
+
+	stream := new(bytes.Buffer)
+	enc := asserts.NewEncoder(stream)
+	asserts.EncoderAppend(enc, []byte(exampleBodyAndExtraHeaders))
+	asserts.EncoderAppend(enc, []byte(exampleEmptyBodyAllDefaults))
+
+	decoder := asserts.NewDecoder(stream)
+	decoder.SetBufferPool(pool)
+
+	a1, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a1.Body(), DeepEquals, []byte("THE-BODY"))
+	c.Check(asserts.Encode(a1), DeepEquals, []byte(exampleBodyAndExtraHeaders))
+
+	a2, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a2.Header("primary-key"), Equals, "abc")
+	c.Check(a2.Body(), HasLen, 0)
+	// both borrowed their own buffer
+	c.Check(allocated, Equals, 2)
+
+	asserts.ReleaseAssertion(a1)
+	c.Check(a1.Body(), IsNil)
+	// releasing twice is harmless
+	asserts.ReleaseAssertion(a1)
+
+	_, err = decoder.Decode()
+	c.Check(err, Equals, io.EOF)
+}
+
+func (as *assertsSuite) TestDecoderBufferPoolErrorGivesBackBuffer(c *C) {
+	var buf *bytes.Buffer
+	pool := &sync.Pool{New: func() interface{} {
+		c.Assert(buf, IsNil)
+		buf = new(bytes.Buffer)
+		return buf
+	}}
+
+	invalid := strings.Replace(exampleBodyAndExtraHeaders, "primary-key: abc\n", "", 1)
+	decoder := asserts.NewDecoder(strings.NewReader(invalid + "\n" + invalid))
+	decoder.SetBufferPool(pool)
+	_, err := decoder.Decode()
+	c.Assert(err, ErrorMatches, `assertion test-only: "primary-key" header is mandatory`)
+	c.Assert(buf, NotNil)
+	// the buffer is given back to the pool, there is no new allocation
+	_, err = decoder.Decode()
+	c.Assert(err, ErrorMatches, `assertion test-only: "primary-key" header is mandatory`)
+}
+
+func (as *assertsSuite) TestReleaseAssertionNotBorrowed(c *C) {
+	a, err := asserts.Decode([]byte(exampleBodyAndExtraHeaders))
+	c.Assert(err, IsNil)
+	asserts.ReleaseAssertion(a)
+	c.Check(a.Body(), DeepEquals, []byte("THE-BODY"))
+}
+
+func benchmarkDecode(b *testing.B, pool *sync.Pool) {
+	stream := new(bytes.Buffer)
+	enc := asserts.NewEncoder(stream)
+	for i := 0; i < 100; i++ {
+		asserts.EncoderAppend(enc, []byte(exampleBodyAndExtraHeaders))
+	}
+	encoded := stream.Bytes()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		decoder := asserts.NewDecoder(bytes.NewReader(encoded))
+		if pool != nil {
+			decoder.SetBufferPool(pool)
+		}
+		for {
+			a, err := decoder.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			asserts.ReleaseAssertion(a)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	benchmarkDecode(b, nil)
+}
+
+func BenchmarkDecodeWithBufferPool(b *testing.B) {
+	benchmarkDecode(b, &sync.Pool{New: func() interface{} { return new(bytes.Buffer) }})
+}
+
+func encodeWithBodySize(pk string, size int) string {
+	return "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: " + pk + "\n" +
+		fmt.Sprintf("body-length: %d", size) +
+		"\n\n" +
+		strings.Repeat("x", size) +
+		"\n\n" +
+		"openpgp c2ln"
+}
+
+func (as *assertsSuite) TestDecoderGrowsForBodies(c *C) {
+	sizes := []int{300 * 1024, 400 * 1024, 500 * 1024, 600 * 1024}
+	var encoded []string
+	for i, size := range sizes {
+		encoded = append(encoded, encodeWithBodySize(fmt.Sprint(i), size))
+	}
+	decoder := asserts.NewDecoder(strings.NewReader(strings.Join(encoded, "\n\n")))
+	for i, size := range sizes {
+		a, err := decoder.Decode()
+		c.Assert(err, IsNil)
+		c.Check(a.Header("primary-key"), Equals, fmt.Sprint(i))
+		c.Check(a.Body(), HasLen, size)
+	}
+	_, err := decoder.Decode()
+	c.Check(err, Equals, io.EOF)
+
+	// the buffer was grown once ahead of the first body
+	c.Check(asserts.DecoderRebuffers(decoder), Equals, 1)
+}
+
+func (as *assertsSuite) TestDecoderGrowsForBodiesUpToMaxBodySize(c *C) {
+	encoded := encodeWithBodySize("0", 1024)
+	decoder := asserts.NewDecoderStressed(strings.NewReader(encoded), 128, 1024, 1500, 1024)
+	decoder.SetReadAhead(128)
+	a, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Body(), HasLen, 1024)
+	c.Check(asserts.DecoderRebuffers(decoder), Equals, 1)
+	// twice the body length is capped to the maximum body size
+	c.Check(asserts.DecoderBufferSize(decoder), Equals, 1500+128)
+}
+
+func BenchmarkDecodeLargeBody(b *testing.B) {
+	encoded := []byte(encodeWithBodySize("0", 1024*1024))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		decoder := asserts.NewDecoder(bytes.NewReader(encoded))
+		_, err := decoder.Decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if asserts.DecoderRebuffers(decoder) != 1 {
+			b.Fatalf("unexpected rebuffering: %d", asserts.DecoderRebuffers(decoder))
+		}
+	}
+}
+
+func (as *assertsSuite) TestAssembleSignatureWithEmptyLine(c *C) {
+	headers := map[string]string{
+		"type":         "test-only",
+		"authority-id": "auth-id1",
+		"primary-key":  "abc",
+	}
+	content := []byte("type: test-only\nauthority-id: auth-id1\nprimary-key: abc")
+
+	_, err := asserts.Assemble(headers, nil, content, []byte("openpgp c2ln\n\nc2ln"))
+	c.Check(err, ErrorMatches, "assertion signature cannot contain empty lines")
+
+	// trailing newlines are fine
+	_, err = asserts.Assemble(headers, nil, content, []byte("openpgp c2ln\n\n"))
+	c.Check(err, IsNil)
+}
+
+func (as *assertsSuite) TestDecoderSignatureWithEmptyLine(c *C) {
+	stream := exampleEmptyBodyAllDefaults + "\n\nc2ln\n\n" + exampleBodyAndExtraHeaders
+	decoder := asserts.NewDecoder(strings.NewReader(stream))
+
+	// the empty line ends the signature
+	a, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	_, sig := a.Signature()
+	c.Check(string(sig), Equals, "openpgp c2ln\n")
+
+	// and what follows is not taken as part of it
+	_, err = decoder.Decode()
+	c.Check(err, ErrorMatches, `parsing assertion headers: header entry missing ':' separator: "c2ln"`)
+}
+
+func (as *assertsSuite) TestDecoderLastAssertionTrailingNewline(c *C) {
+	for _, trailer := range []string{"", "\n"} {
+		last := strings.TrimSuffix(exampleBodyAndExtraHeaders, "\n") + trailer
+		stream := exampleEmptyBodyAllDefaults + "\n\n" + last
+		decoder := asserts.NewDecoder(strings.NewReader(stream))
+
+		a1, err := decoder.Decode()
+		c.Assert(err, IsNil)
+		c.Check(a1.Header("primary-key"), Equals, "abc")
+
+		a2, err := decoder.Decode()
+		c.Assert(err, IsNil)
+		c.Check(a2.Body(), DeepEquals, []byte("THE-BODY"))
+		_, sig := a2.Signature()
+		c.Check(string(sig), Equals, "openpgp c2ln"+trailer)
+
+		_, err = decoder.Decode()
+		c.Check(err, Equals, io.EOF)
+	}
+}
+
+func (as *assertsSuite) TestDecoderMinRevision(c *C) {
+	rev := func(pk string, revision int) string {
+		return "type: test-only\n" +
+			"authority-id: auth-id1\n" +
+			"primary-key: " + pk + "\n" +
+			fmt.Sprintf("revision: %d", revision) +
+			"\n\n" +
+			"openpgp c2ln"
+	}
+	stream := strings.Join([]string{
+		rev("a", 1),
+		rev("b", 0),
+		rev("a", 3),
+		rev("a", 2),
+		rev("c", 7),
+	}, "\n\n")
+
+	held := map[string]int{
+		"test-only/a": 2,
+		"test-only/c": 8,
+	}
+	var lookups []string
+	decoder := asserts.NewDecoder(strings.NewReader(stream))
+	decoder.SetMinRevision(func(ref asserts.Ref) int {
+		lookups = append(lookups, ref.PrimaryKey[0])
+		return held[ref.Type.Name+"/"+ref.PrimaryKey[0]]
+	})
+
+	var got []string
+	for {
+		a, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		got = append(got, fmt.Sprintf("%s/%d", a.Header("primary-key"), a.Revision()))
+	}
+	c.Check(got, DeepEquals, []string{"b/0", "a/3", "a/2"})
+	c.Check(lookups, DeepEquals, []string{"a", "b", "a", "a", "c"})
+}
+
+func (as *assertsSuite) TestDecoderAllowedTypes(c *C) {
+	disallowed := "type: test-only-2\n" +
+		"authority-id: auth-id1\n" +
+		"pk1: a\n" +
+		"pk2: b" +
+		"\n\n" +
+		"openpgp c2ln"
+	stream := disallowed + "\n\n" + exampleEmptyBodyAllDefaults
+
+	// error mode
+	decoder := asserts.NewDecoder(strings.NewReader(stream))
+	decoder.SetAllowedTypes([]string{"test-only"}, false)
+	_, err := decoder.Decode()
+	c.Assert(err, FitsTypeOf, &asserts.TypeNotAllowedError{})
+	c.Check(err, ErrorMatches, `assertion type "test-only-2" is not allowed`)
+	a, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.TestOnlyType)
+	_, err = decoder.Decode()
+	c.Check(err, Equals, io.EOF)
+
+	// skip mode
+	decoder = asserts.NewDecoder(strings.NewReader(stream))
+	decoder.SetAllowedTypes([]string{"test-only"}, true)
+	a, err = decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.TestOnlyType)
+	_, err = decoder.Decode()
+	c.Check(err, Equals, io.EOF)
+}
+
+func (as *assertsSuite) TestMultiStream(c *C) {
+	first := exampleEmptyBodyAllDefaults
+	second := exampleBodyAndExtraHeaders
+	for _, trailer := range []string{"", "\n", "\n\n"} {
+		for _, oneByte := range []bool{false, true} {
+			comment := Commentf("trailer: %q, one byte: %v", trailer, oneByte)
+			var readers []io.Reader
+			for _, data := range []string{"", first + trailer, "", second} {
+				var r io.Reader = strings.NewReader(data)
+				if oneByte {
+					r = iotest.OneByteReader(r)
+				}
+				readers = append(readers, r)
+			}
+
+			decoder := asserts.NewDecoder(asserts.MultiStream(readers...))
+			a1, err := decoder.Decode()
+			c.Assert(err, IsNil, comment)
+			checkContent(c, a1, first)
+
+			a2, err := decoder.Decode()
+			c.Assert(err, IsNil, comment)
+			checkContent(c, a2, second)
+
+			_, err = decoder.Decode()
+			c.Check(err, Equals, io.EOF, comment)
+		}
+	}
+}
+
+func (as *assertsSuite) TestDecoderMaxHeaderValueSize(c *C) {
+	stream := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"short: value\n" +
+		"long: " + strings.Repeat("x", 40) +
+		"\n\n" +
+		"openpgp c2ln"
+
+	decoder := asserts.NewDecoder(strings.NewReader(stream))
+	a, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Header("long"), HasLen, 40)
+
+	decoder = asserts.NewDecoder(strings.NewReader(stream))
+	decoder.SetMaxHeaderValueSize(32)
+	_, err = decoder.Decode()
+	c.Check(err, ErrorMatches, `parsing assertion headers: header "long" value exceeds maximum size of 32 bytes`)
+
+	multiline := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"long:\n " + strings.Repeat("x", 20) + "\n " + strings.Repeat("y", 20) +
+		"\n\n" +
+		"openpgp c2ln"
+
+	decoder = asserts.NewDecoder(strings.NewReader(multiline))
+	decoder.SetMaxHeaderValueSize(41)
+	a, err = decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Header("long"), HasLen, 41)
+
+	decoder = asserts.NewDecoder(strings.NewReader(multiline))
+	decoder.SetMaxHeaderValueSize(40)
+	_, err = decoder.Decode()
+	c.Check(err, ErrorMatches, `parsing assertion headers: header "long" value exceeds maximum size of 40 bytes`)
+}
+
+func (as *assertsSuite) TestDecodeHeaderValueTooBig(c *C) {
+	// under the overall headers limit but over the single value one
+	encoded := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"big: " + strings.Repeat("x", asserts.MaxHeaderValueSize+1) +
+		"\n\n" +
+		"openpgp c2ln"
+	c.Assert(len(encoded) < asserts.MaxHeadersSize, Equals, true)
+	_, err := asserts.Decode([]byte(encoded))
+	c.Check(err, ErrorMatches, `parsing assertion headers: header "big" value exceeds maximum size of 65536 bytes`)
+}
+
+func (as *assertsSuite) TestDecoderHeaderObserver(c *C) {
+	encoded := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"zzz: last\n" +
+		"multi:\n line1\n line2\n" +
+		"aaa: first\n" +
+		"body-length: 8\n\n" +
+		"THE-BODY" +
+		"\n\n" +
+		"openpgp c2ln"
+
+	var observed []string
+	decoder := asserts.NewDecoder(strings.NewReader(encoded))
+	decoder.SetHeaderObserver(func(name, value string) {
+		observed = append(observed, name+"="+value)
+	})
+	a, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(observed, DeepEquals, []string{
+		"type=test-only",
+		"authority-id=auth-id1",
+		"primary-key=abc",
+		"zzz=last",
+		"multi=line1\nline2",
+		"aaa=first",
+		"body-length=8",
+	})
+
+	// parsing is unaffected
+	expected, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	c.Check(a.Headers(), DeepEquals, expected.Headers())
+}
+
+func (as *assertsSuite) TestDecoderHeaderNamePolicy(c *C) {
+	stream := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"x: single\n" +
+		"y:\n multi\n line" +
+		"\n\n" +
+		"openpgp c2ln"
+
+	// the default policy rejects single character names
+	decoder := asserts.NewDecoder(strings.NewReader(stream))
+	_, err := decoder.Decode()
+	c.Check(err, ErrorMatches, `parsing assertion headers: invalid header name: "x"`)
+
+	decoder = asserts.NewDecoder(strings.NewReader(stream))
+	decoder.SetHeaderNamePolicy(regexp.MustCompile("^[a-z](?:[a-z0-9-]*[a-z0-9])?$"))
+	a, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Header("x"), Equals, "single")
+	c.Check(a.Header("y"), Equals, "multi\nline")
+
+	// nil restores the default
+	decoder = asserts.NewDecoder(strings.NewReader(stream))
+	decoder.SetHeaderNamePolicy(nil)
+	_, err = decoder.Decode()
+	c.Check(err, ErrorMatches, `parsing assertion headers: invalid header name: "x"`)
+}
+
+func (as *assertsSuite) TestAuthorities(c *C) {
+	stream := exampleBodyAndExtraHeaders + "\n" +
+		exampleEmptyBodyAllDefaults + "\n\n" +
+		exampleBodyAndExtraHeaders
+
+	authorities, err := asserts.Authorities(strings.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Check(authorities, DeepEquals, []string{"auth-id1", "auth-id2"})
+
+	authorities, err = asserts.Authorities(strings.NewReader(""))
+	c.Assert(err, IsNil)
+	c.Check(authorities, HasLen, 0)
+
+	_, err = asserts.Authorities(strings.NewReader(exampleEmptyBodyAllDefaults + "\n\ntype: test-only\n"))
+	c.Check(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func (as *assertsSuite) TestDecoderRequireRevision(c *C) {
+	withRevision := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"revision: 0\n" +
+		"primary-key: abc" +
+		"\n\n" +
+		"openpgp c2ln"
+	negativeRevision := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"revision: -1\n" +
+		"primary-key: abc" +
+		"\n\n" +
+		"openpgp c2ln"
+
+	tests := []struct {
+		encoded  string
+		required bool
+		err      string
+	}{
+		{withRevision, false, ""},
+		{withRevision, true, ""},
+		{exampleEmptyBodyAllDefaults, false, ""},
+		{exampleEmptyBodyAllDefaults, true, `assertion: "revision" header is mandatory`},
+		{negativeRevision, false, `assertion: revision should be positive: -1`},
+		{negativeRevision, true, `assertion: revision should be positive: -1`},
+	}
+	for _, test := range tests {
+		decoder := asserts.NewDecoder(strings.NewReader(test.encoded))
+		decoder.SetRequireRevision(test.required)
+		a, err := decoder.Decode()
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err, Commentf("required: %v", test.required))
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(a.Revision(), Equals, 0)
+	}
+}
+
+func (as *assertsSuite) TestTimestamp(c *C) {
+	ts := time.Now().Truncate(time.Second).UTC()
+	encoded := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"timestamp: " + ts.Format(time.RFC3339) +
+		"\n\n" +
+		"openpgp c2ln"
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	timestamp, err := asserts.Timestamp(a)
+	c.Assert(err, IsNil)
+	c.Check(timestamp.Equal(ts), Equals, true)
+
+	a, err = asserts.Decode([]byte(exampleEmptyBodyAllDefaults))
+	c.Assert(err, IsNil)
+	_, err = asserts.Timestamp(a)
+	c.Check(err, ErrorMatches, `assertion test-only: "timestamp" header is mandatory`)
+
+	a, err = asserts.Decode([]byte(strings.Replace(encoded, ts.Format(time.RFC3339), "12:30", 1)))
+	c.Assert(err, IsNil)
+	_, err = asserts.Timestamp(a)
+	c.Check(err, ErrorMatches, `assertion test-only: "timestamp" header is not a RFC3339 date: .*`)
+}
+
+func (as *assertsSuite) TestNestedAssertion(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"body-format":  "assertion",
+	}
+	outer, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte(exampleBodyAndExtraHeaders), testPrivKey1)
+	c.Assert(err, IsNil)
+
+	decoded, err := asserts.Decode(asserts.Encode(outer))
+	c.Assert(err, IsNil)
+	nested, err := asserts.NestedAssertion(decoded)
+	c.Assert(err, IsNil)
+	c.Check(nested.Type(), Equals, asserts.TestOnlyType)
+	c.Check(nested.AuthorityID(), Equals, "auth-id2")
+	c.Check(nested.Body(), DeepEquals, []byte("THE-BODY"))
+	c.Check(asserts.Encode(nested), DeepEquals, []byte(exampleBodyAndExtraHeaders))
+}
+
+func (as *assertsSuite) TestNestedAssertionErrors(c *C) {
+	a, err := asserts.Decode([]byte(exampleBodyAndExtraHeaders))
+	c.Assert(err, IsNil)
+	_, err = asserts.NestedAssertion(a)
+	c.Check(err, ErrorMatches, "assertion test-only does not declare a nested assertion as body")
+
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"body-format":  "assertion",
+	}
+	a, err = asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("not an assertion"), testPrivKey1)
+	c.Assert(err, IsNil)
+	_, err = asserts.NestedAssertion(a)
+	c.Check(err, ErrorMatches, "cannot decode nested assertion: .*")
+}
+
+func (as *assertsSuite) TestDecoderMaxClockSkew(c *C) {
+	now := time.Now().Truncate(time.Second).UTC()
+	encode := func(ts time.Time) string {
+		return "type: test-only\n" +
+			"authority-id: auth-id1\n" +
+			"primary-key: abc\n" +
+			"timestamp: " + ts.Format(time.RFC3339) +
+			"\n\n" +
+			"openpgp c2ln"
+	}
+	future := now.Add(48 * time.Hour)
+
+	tests := []struct {
+		encoded string
+		skew    time.Duration
+		err     string
+	}{
+		{encode(now), time.Hour, ""},
+		{encode(now.Add(30 * time.Minute)), time.Hour, ""},
+		{exampleEmptyBodyAllDefaults, time.Hour, ""},
+		{encode(future), 0, ""},
+		{encode(future), time.Hour, "assertion test-only: timestamp " + future.Format(time.RFC3339) + " is too far in the future"},
+	}
+	for _, test := range tests {
+		decoder := asserts.NewDecoder(strings.NewReader(test.encoded))
+		decoder.SetMaxClockSkew(test.skew)
+		_, err := decoder.Decode()
+		if test.err == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+func (as *assertsSuite) TestTypeHistogram(c *C) {
+	unknown := "type: unknown-type\n" +
+		"authority-id: auth-id1\n" +
+		"body-length: 4" +
+		"\n\n" +
+		"BODY" +
+		"\n\n" +
+		"openpgp c2ln"
+	test2 := "type: test-only-2\n" +
+		"authority-id: auth-id1\n" +
+		"pk1: a\n" +
+		"pk2: b" +
+		"\n\n" +
+		"openpgp c2ln"
+	stream := exampleBodyAndExtraHeaders + "\n" +
+		exampleEmptyBodyAllDefaults + "\n\n" +
+		unknown + "\n\n" +
+		test2 + "\n\n" +
+		exampleEmptyBody2NlNl
+
+	hist, err := asserts.TypeHistogram(strings.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Check(hist, DeepEquals, map[string]int{
+		"test-only":    3,
+		"test-only-2":  1,
+		"unknown-type": 1,
+	})
+
+	hist, err = asserts.TypeHistogram(strings.NewReader(""))
+	c.Assert(err, IsNil)
+	c.Check(hist, HasLen, 0)
+
+	_, err = asserts.TypeHistogram(strings.NewReader(exampleEmptyBodyAllDefaults + "\n\nauthority-id: auth-id1\n\nopenpgp c2ln"))
+	c.Check(err, ErrorMatches, `assertion: "type" header is mandatory`)
+
+	_, err = asserts.TypeHistogram(strings.NewReader(exampleEmptyBodyAllDefaults + "\n\ntype: test-only\nbody-length: 10\n\nshort"))
+	c.Check(err, Equals, io.ErrUnexpectedEOF)
+}
+
+// tricklingReader returns a byte at a time after a delay
+type tricklingReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (tr *tricklingReader) Read(p []byte) (int, error) {
+	time.Sleep(tr.delay)
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return tr.r.Read(p)
+}
+
+func (as *assertsSuite) TestDecoderAssertionTimeout(c *C) {
+	tr := &tricklingReader{r: strings.NewReader(exampleBodyAndExtraHeaders), delay: time.Millisecond}
+	decoder := asserts.NewDecoder(tr)
+	decoder.SetAssertionTimeout(20 * time.Millisecond)
+
+	_, err := decoder.Decode()
+	c.Check(err, Equals, asserts.ErrAssertionTimeout)
+}
+
+func (as *assertsSuite) TestDecoderAssertionTimeoutBlockedRead(c *C) {
+	// a plain reader blocking inside Read after the headers
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go pw.Write([]byte("type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"body-length: 10" +
+		"\n\n"))
+
+	decoder := asserts.NewDecoder(pr)
+	decoder.SetAssertionTimeout(50 * time.Millisecond)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := decoder.Decode()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		c.Check(err, Equals, asserts.ErrAssertionTimeout)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Decode did not return after the assertion timeout")
+	}
+
+	// the decoder is unusable afterwards
+	_, err := decoder.Decode()
+	c.Check(err, Equals, asserts.ErrAssertionTimeout)
+}
+
+func (as *assertsSuite) TestDecoderAssertionTimeoutNotExceeded(c *C) {
+	stream := exampleEmptyBodyAllDefaults + "\n\n" + exampleBodyAndExtraHeaders
+	decoder := asserts.NewDecoder(strings.NewReader(stream))
+	decoder.SetAssertionTimeout(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		_, err := decoder.Decode()
+		c.Assert(err, IsNil)
+	}
+	_, err := decoder.Decode()
+	c.Check(err, Equals, io.EOF)
+}
+
+func (as *assertsSuite) TestDecoderConnReadDeadline(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, IsNil)
+	defer client.Close()
+	conn, err := l.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// the body never arrives
+	_, err = client.Write([]byte("type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc\n" +
+		"body-length: 10" +
+		"\n\n"))
+	c.Assert(err, IsNil)
+
+	decoder := asserts.NewDecoder(conn)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := decoder.Decode()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		netErr, ok := err.(net.Error)
+		c.Assert(ok, Equals, true, Commentf("%v", err))
+		c.Check(netErr.Timeout(), Equals, true)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Decode did not return after the read deadline")
+	}
+}
+
+func (as *assertsSuite) TestDecoderConnReadDeadlineIdle(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, IsNil)
+	defer client.Close()
+	conn, err := l.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// nothing arrives at all, or only part of the headers
+	for _, sent := range []string{"", "type: test-only\n"} {
+		if sent != "" {
+			_, err = client.Write([]byte(sent))
+			c.Assert(err, IsNil)
+		}
+
+		decoder := asserts.NewDecoder(conn)
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := decoder.Decode()
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			netErr, ok := err.(net.Error)
+			c.Assert(ok, Equals, true, Commentf("%v", err))
+			c.Check(netErr.Timeout(), Equals, true)
+			c.Check(err, ErrorMatches, "error reading assertion headers: .*i/o timeout")
+		case <-time.After(5 * time.Second):
+			c.Fatal("Decode did not return after the read deadline")
+		}
+	}
+}
+
+func (as *assertsSuite) TestDecoderConnReadDeadlineWithAssertionTimeout(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	c.Assert(err, IsNil)
+	defer client.Close()
+	conn, err := l.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = client.Write([]byte(exampleEmptyBodyAllDefaults + "\n\n"))
+	c.Assert(err, IsNil)
+
+	decoder := asserts.NewDecoder(conn)
+	decoder.SetAssertionTimeout(time.Minute)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := decoder.Decode()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		// nothing else arrives, the deadline set by the caller
+		// is still in effect after the first Decode
+		_, err = decoder.Decode()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		c.Check(err, Not(Equals), asserts.ErrAssertionTimeout)
+		c.Check(err, ErrorMatches, ".*i/o timeout")
+	case <-time.After(5 * time.Second):
+		c.Fatal("Decode did not return after the read deadline")
+	}
+}
+
+func (as *assertsSuite) TestCheckRegistry(c *C) {
+	c.Check(asserts.CheckRegistry(), IsNil)
+}
+
+func (as *assertsSuite) TestCheckRegistryBroken(c *C) {
+	good := asserts.AssertionTypeInTest("good", []string{"pk"}, true)
+
+	tests := []struct {
+		registry    map[string]*asserts.AssertionType
+		expectedErr string
+	}{
+		{map[string]*asserts.AssertionType{"good": good, "nil": nil}, `assertion type registered as "nil" is nil`},
+		{map[string]*asserts.AssertionType{"empty": asserts.AssertionTypeInTest("", []string{"pk"}, true)}, `assertion type registered as "empty" has an empty name`},
+		{map[string]*asserts.AssertionType{"other": good}, `assertion type "good" is registered as "other"`},
+		{map[string]*asserts.AssertionType{"": asserts.AssertionTypeInTest("", []string{"pk"}, true)}, `assertion type registered as "" has an empty name`},
+		{map[string]*asserts.AssertionType{"no-pk": asserts.AssertionTypeInTest("no-pk", nil, true)}, `assertion type "no-pk" has no primary key headers`},
+		{map[string]*asserts.AssertionType{"no-asm": asserts.AssertionTypeInTest("no-asm", []string{"pk"}, false)}, `assertion type "no-asm" has no assembler`},
+	}
+	for _, test := range tests {
+		c.Check(asserts.CheckRegistryInTest(test.registry), ErrorMatches, test.expectedErr)
+	}
+	c.Check(asserts.CheckRegistryInTest(map[string]*asserts.AssertionType{"good": good}), IsNil)
+}
+
+func (as *assertsSuite) TestSelfCheck(c *C) {
+	for _, encoded := range []string{exampleBodyAndExtraHeaders, exampleEmptyBodyAllDefaults} {
+		a, err := asserts.Decode([]byte(encoded))
+		c.Assert(err, IsNil)
+		c.Check(asserts.SelfCheck(a), IsNil)
+	}
+
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"multi":        "a\nb",
+	}, []byte("body"), testPrivKey1)
+	c.Assert(err, IsNil)
+	c.Check(asserts.SelfCheck(a), IsNil)
+}
+
+func (as *assertsSuite) TestSelfCheckTampered(c *C) {
+	type tamperer interface {
+		TamperInTest(name, value string)
+	}
+
+	tests := []struct {
+		name, value string
+		expectedErr string
+	}{
+		{"header1", "tampered", "assertion headers do not match its content"},
+		{"extra", "x", "assertion headers do not match its content"},
+		{"revision", "", "assertion revision does not match its content"},
+		{"", "THE-BODZ", "assertion body does not match its content"},
+	}
+	for _, test := range tests {
+		a, err := asserts.Decode([]byte(exampleBodyAndExtraHeaders))
+		c.Assert(err, IsNil)
+		a.(tamperer).TamperInTest(test.name, test.value)
+		c.Check(asserts.SelfCheck(a), ErrorMatches, test.expectedErr)
+	}
+}
+
+const exampleUnknownType = "type: made-up\n" +
+	"authority-id: auth-id1\n" +
+	"made-up-id: xyz\n" +
+	"body-length: 4\n\n" +
+	"BODY" +
+	"\n\n" +
+	"openpgp c2ln\n"
+
+func (as *assertsSuite) TestDecoderUnknownTypeStrictByDefault(c *C) {
+	decoder := asserts.NewDecoder(strings.NewReader(exampleUnknownType))
+	_, err := decoder.Decode()
+	c.Check(err, ErrorMatches, `unknown assertion type: "made-up"`)
+}
+
+func (as *assertsSuite) TestDecoderOpaqueUnknownTypes(c *C) {
+	stream := new(bytes.Buffer)
+	enc := asserts.NewEncoder(stream)
+	asserts.EncoderAppend(enc, []byte(exampleBodyAndExtraHeaders))
+	asserts.EncoderAppend(enc, []byte(exampleUnknownType))
+	asserts.EncoderAppend(enc, []byte(exampleEmptyBodyAllDefaults))
+	encoded := stream.String()
+
+	decoder := asserts.NewDecoder(stream)
+	decoder.SetOpaqueUnknownTypes(true)
+
+	var decoded []asserts.Assertion
+	for {
+		a, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		decoded = append(decoded, a)
+	}
+	c.Assert(decoded, HasLen, 3)
+	c.Check(decoded[0].Type(), Equals, asserts.TestOnlyType)
+	c.Check(decoded[2].Type(), Equals, asserts.TestOnlyType)
+
+	opaque := decoded[1]
+	c.Check(opaque.Type().Name, Equals, "made-up")
+	c.Check(asserts.Type("made-up"), IsNil)
+	c.Check(opaque.AuthorityID(), Equals, "auth-id1")
+	c.Check(opaque.Header("made-up-id"), Equals, "xyz")
+	c.Check(opaque.Body(), DeepEquals, []byte("BODY"))
+	c.Check(opaque.Ref().Type.Name, Equals, "made-up")
+
+	// the stream round-trips
+	out := new(bytes.Buffer)
+	enc = asserts.NewEncoder(out)
+	for _, a := range decoded {
+		err := enc.Encode(a)
+		c.Assert(err, IsNil)
+	}
+	c.Check(out.String(), Equals, encoded)
+}
+
+func (as *assertsSuite) TestRef(c *C) {
+	a, err := asserts.Decode([]byte(exampleBodyAndExtraHeaders))
+	c.Assert(err, IsNil)
+
+	c.Check(a.Ref(), DeepEquals, asserts.Ref{
+		Type:       asserts.TestOnlyType,
+		PrimaryKey: []string{"abc"},
+	})
+}
+
+func (as *assertsSuite) TestHeaderDiff(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"header1":      "a",
+	}
+	a1, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey1)
+	c.Assert(err, IsNil)
+
+	c.Check(asserts.HeaderDiff(a1, a1), HasLen, 0)
+
+	delete(headers, "header1")
+	headers["header2"] = "b"
+	a2, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey1)
+	c.Assert(err, IsNil)
+
+	c.Check(asserts.HeaderDiff(a1, a2), DeepEquals, map[string][2]string{
+		"header1": {"a", ""},
+		"header2": {"", "b"},
+	})
+}
+
+const draftWithComments = `# draft for the test-only assertion
+authority-id: auth-id1
+# the primary key
+primary-key: abc
+multi:
+ line1
+# inside a multiline value
+ line2
+`
+
+func (as *assertsSuite) TestParseDraftHeadersWithComments(c *C) {
+	headers, err := asserts.ParseDraftHeaders([]byte(draftWithComments), true)
+	c.Assert(err, IsNil)
+	c.Check(headers, DeepEquals, map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "abc",
+		"multi":        "line1\nline2",
+	})
+
+	// comments do not make it into the signed content
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey1)
+	c.Assert(err, IsNil)
+	content, _ := a.Signature()
+	c.Check(bytes.Contains(content, []byte("#")), Equals, false)
+}
+
+func (as *assertsSuite) TestParseDraftHeadersStrict(c *C) {
+	_, err := asserts.ParseDraftHeaders([]byte(draftWithComments), false)
+	c.Check(err, ErrorMatches, `header entry missing ':' separator: "# draft for the test-only assertion"`)
+
+	_, err = asserts.ParseDraftHeaders([]byte("#note: x\nprimary-key: abc\n"), false)
+	c.Check(err, ErrorMatches, `invalid header name: "#note"`)
+
+	headers, err := asserts.ParseDraftHeaders([]byte("authority-id: auth-id1\nprimary-key: abc\n"), false)
+	c.Assert(err, IsNil)
+	c.Check(headers, DeepEquals, map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "abc",
+	})
+}
+
+func (as *assertsSuite) TestDecodeRejectsHeaderComments(c *C) {
+	_, err := asserts.Decode([]byte("type: test-only\n# comment\nauthority-id: auth-id1\nprimary-key: abc\n\nopenpgp c2ln"))
+	c.Check(err, ErrorMatches, `parsing assertion headers: header entry missing ':' separator: "# comment"`)
+}
+
+func (as *assertsSuite) TestEqualIgnoringRevision(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+		"header1":      "a",
+	}
+	a1, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("body"), testPrivKey1)
+	c.Assert(err, IsNil)
+
+	c.Check(asserts.EqualIgnoringRevision(a1, a1), Equals, true)
+
+	headers["revision"] = "3"
+	a2, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("body"), testPrivKey1)
+	c.Assert(err, IsNil)
+
+	// same content, different revision
+	c.Check(asserts.EqualIgnoringRevision(a1, a2), Equals, true)
+	c.Check(asserts.EqualIgnoringRevision(a2, a1), Equals, true)
+
+	a3, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("changed"), testPrivKey1)
+	c.Assert(err, IsNil)
+
+	// changed body
+	c.Check(asserts.EqualIgnoringRevision(a2, a3), Equals, false)
+
+	headers["header1"] = "b"
+	a4, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("body"), testPrivKey1)
+	c.Assert(err, IsNil)
+
+	// changed header
+	c.Check(asserts.EqualIgnoringRevision(a2, a4), Equals, false)
+}
+
+func (as *assertsSuite) TestDecoderCRLFBody(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+	}
+	a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte("line1\r\nline2\r\n"), testPrivKey1)
+	c.Assert(err, IsNil)
+	encoded := asserts.Encode(a)
+
+	// strict by default
+	decoder := asserts.NewDecoder(bytes.NewReader(encoded))
+	_, err = decoder.Decode()
+	c.Check(err, ErrorMatches, "assertion body contains CRLF line endings")
+
+	// as is Decode
+	_, err = asserts.Decode(encoded)
+	c.Check(err, ErrorMatches, "assertion body contains CRLF line endings")
+
+	decoder = asserts.NewDecoder(bytes.NewReader(encoded))
+	decoder.SetBodyLineEndings(asserts.RejectCRLFBodies)
+	_, err = decoder.Decode()
+	c.Check(err, ErrorMatches, "assertion body contains CRLF line endings")
+
+	decoder = asserts.NewDecoder(bytes.NewReader(encoded))
+	decoder.SetBodyLineEndings(asserts.NormalizeCRLFBodies)
+	normalized, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	c.Check(normalized.Body(), DeepEquals, []byte("line1\nline2\n"))
+	c.Check(normalized.Header("body-length"), Equals, "12")
+
+	// the normalized assertion decodes the same
+	redecoded, err := asserts.Decode(asserts.Encode(normalized))
+	c.Assert(err, IsNil)
+	c.Check(redecoded.Body(), DeepEquals, []byte("line1\nline2\n"))
+
+	// but its signature is invalidated
+	err = asserts.VerifyWithPublicKey(normalized, testPrivKey1.PublicKey())
+	c.Check(err, NotNil)
+	c.Check(asserts.VerifyWithPublicKey(a, testPrivKey1.PublicKey()), IsNil)
+}
+
+func (as *assertsSuite) TestCheckBodyContentType(c *C) {
+	headers := map[string]string{
+		"authority-id": "auth-id1",
+		"primary-key":  "0",
+	}
+
+	tests := []struct {
+		contentType string
+		body        string
+		err         string
+	}{
+		{"", "not json", ""},
+		{"application/json", `{"a": [1, 2]}`, ""},
+		{"application/json; charset=utf-8", `{"a": [1, 2]}`, ""},
+		{"application/json", "THE-BODY", `assertion test-only body does not look like its declared content-type "application/json"`},
+		{"text/plain", "THE-BODY", ""},
+		{"text/plain", "THE\x00BODY", `assertion test-only body does not look like its declared content-type "text/plain"`},
+		{"image/png", "THE-BODY", ""},
+		{"image/png", "%PDF-1.4 ...", `assertion test-only body does not look like its declared content-type "image/png"`},
+		{"application/pdf", "%PDF-1.4 ...", ""},
+		{"//", "THE-BODY", `assertion test-only: invalid content-type "//": .*`},
+	}
+
+	for _, test := range tests {
+		if test.contentType != "" {
+			headers["content-type"] = test.contentType
+		}
+		a, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, []byte(test.body), testPrivKey1)
+		c.Assert(err, IsNil)
+
+		err = asserts.CheckBodyContentType(a)
+		if test.err == "" {
+			c.Check(err, IsNil, Commentf("content-type %q", test.contentType))
+		} else {
+			c.Check(err, ErrorMatches, test.err)
+		}
+	}
+}
+
+func (as *assertsSuite) TestDecoderMaxStreamBytes(c *C) {
+	stream := new(bytes.Buffer)
+	enc := asserts.NewEncoder(stream)
+	asserts.EncoderAppend(enc, []byte(exampleEmptyBody2NlNl))
+	firstLen := stream.Len()
+	asserts.EncoderAppend(enc, []byte(exampleBodyAndExtraHeaders))
+	asserts.EncoderAppend(enc, []byte(exampleEmptyBodyAllDefaults))
+	total := stream.Len()
+
+	// the whole stream fits
+	decoder := asserts.NewDecoder(bytes.NewReader(stream.Bytes()))
+	decoder.SetMaxStreamBytes(total)
+	for i := 0; i < 3; i++ {
+		_, err := decoder.Decode()
+		c.Assert(err, IsNil)
+	}
+	_, err := decoder.Decode()
+	c.Check(err, Equals, io.EOF)
+
+	// the limit is exceeded while decoding the second assertion
+	decoder = asserts.NewDecoder(bytes.NewReader(stream.Bytes()))
+	decoder.SetMaxStreamBytes(firstLen + 20)
+	a, err := decoder.Decode()
+	c.Assert(err, IsNil)
+	checkContent(c, a, exampleEmptyBody2NlNl)
+
+	a, err = decoder.Decode()
+	c.Check(a, IsNil)
+	c.Check(err, Equals, asserts.ErrMaxStreamBytesExceeded)
+
+	_, err = decoder.Decode()
+	c.Check(err, Equals, asserts.ErrMaxStreamBytesExceeded)
+}
@@ -0,0 +1,67 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// CheckBodyContentType loosely checks, by sniffing the body, that the
+// body of the assertion matches its declared "content-type" header if
+// any. Sniffing is heuristic so this check is opt-in, only an obvious
+// mismatch results in an error.
+func CheckBodyContentType(assert Assertion) error {
+	declared := assert.Header("content-type")
+	body := assert.Body()
+	if declared == "" || len(body) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return fmt.Errorf("assertion %s: invalid content-type %q: %v", assert.Type().Name, declared, err)
+	}
+	if !bodyLooksLike(mediaType, body) {
+		return fmt.Errorf("assertion %s body does not look like its declared content-type %q", assert.Type().Name, mediaType)
+	}
+	return nil
+}
+
+func bodyLooksLike(mediaType string, body []byte) bool {
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v interface{}
+		return json.Unmarshal(body, &v) == nil
+	case strings.HasPrefix(mediaType, "text/"):
+		return utf8.Valid(body) && bytes.IndexByte(body, 0) == -1
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	switch sniffed {
+	case "application/octet-stream", "text/plain":
+		// nothing specific was detected
+		return true
+	}
+	return sniffed == mediaType
+}
@@ -0,0 +1,148 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapDeclarationParams holds the properties of a snap-declaration
+// to build with BuildSnapDeclaration.
+type SnapDeclarationParams struct {
+	AuthorityID string
+	Revision    int
+	Series      string
+	SnapID      string
+	SnapName    string
+	PublisherID string
+	Gates       []string
+	Timestamp   time.Time
+}
+
+// BuildSnapDeclaration validates the params and builds a
+// snap-declaration assertion signed with the given private key.
+func BuildSnapDeclaration(params SnapDeclarationParams, key PrivateKey) (Assertion, error) {
+	err := checkBuildParams(SnapDeclarationType,
+		buildParam{"authority-id", params.AuthorityID, accountIDFormat},
+		buildParam{"series", params.Series, seriesFormat},
+		buildParam{"snap-id", params.SnapID, snapIDFormat},
+		buildParam{"snap-name", params.SnapName, nil},
+		buildParam{"publisher-id", params.PublisherID, accountIDFormat},
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, gate := range params.Gates {
+		if !snapIDFormat.MatchString(gate) {
+			return nil, fmt.Errorf("cannot build snap-declaration: invalid snap-id in gates: %q", gate)
+		}
+	}
+	if params.Timestamp.IsZero() {
+		return nil, fmt.Errorf("cannot build snap-declaration: timestamp is required")
+	}
+
+	headers := map[string]string{
+		"authority-id": params.AuthorityID,
+		"series":       params.Series,
+		"snap-id":      params.SnapID,
+		"snap-name":    params.SnapName,
+		"publisher-id": params.PublisherID,
+		"gates":        strings.Join(params.Gates, ","),
+		"timestamp":    params.Timestamp.UTC().Format(time.RFC3339),
+	}
+	if params.Revision != 0 {
+		headers["revision"] = strconv.Itoa(params.Revision)
+	}
+	return assembleAndSign(SnapDeclarationType, headers, nil, key)
+}
+
+// SnapRevisionParams holds the properties of a snap-revision to build
+// with BuildSnapRevision.
+type SnapRevisionParams struct {
+	AuthorityID  string
+	Revision     int
+	Series       string
+	SnapID       string
+	SnapDigest   string
+	SnapSize     uint64
+	SnapRevision uint64
+	DeveloperID  string
+	Timestamp    time.Time
+}
+
+// BuildSnapRevision validates the params and builds a snap-revision
+// assertion signed with the given private key.
+func BuildSnapRevision(params SnapRevisionParams, key PrivateKey) (Assertion, error) {
+	err := checkBuildParams(SnapRevisionType,
+		buildParam{"authority-id", params.AuthorityID, accountIDFormat},
+		buildParam{"series", params.Series, seriesFormat},
+		buildParam{"snap-id", params.SnapID, snapIDFormat},
+		buildParam{"snap-digest", params.SnapDigest, nil},
+		buildParam{"developer-id", params.DeveloperID, accountIDFormat},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if params.SnapRevision == 0 {
+		return nil, fmt.Errorf("cannot build snap-revision: snap-revision is required")
+	}
+	if params.Timestamp.IsZero() {
+		return nil, fmt.Errorf("cannot build snap-revision: timestamp is required")
+	}
+
+	headers := map[string]string{
+		"authority-id":  params.AuthorityID,
+		"series":        params.Series,
+		"snap-id":       params.SnapID,
+		"snap-digest":   params.SnapDigest,
+		"snap-size":     strconv.FormatUint(params.SnapSize, 10),
+		"snap-revision": strconv.FormatUint(params.SnapRevision, 10),
+		"developer-id":  params.DeveloperID,
+		"timestamp":     params.Timestamp.UTC().Format(time.RFC3339),
+	}
+	if params.Revision != 0 {
+		headers["revision"] = strconv.Itoa(params.Revision)
+	}
+	return assembleAndSign(SnapRevisionType, headers, nil, key)
+}
+
+type buildParam struct {
+	name   string
+	value  string
+	format *regexp.Regexp
+}
+
+// checkBuildParams checks that the given params are set and match
+// their format, if any.
+func checkBuildParams(assertType *AssertionType, params ...buildParam) error {
+	for _, p := range params {
+		if p.value == "" {
+			return fmt.Errorf("cannot build %s: %s is required", assertType.Name, p.name)
+		}
+		if p.format != nil && !p.format.MatchString(p.value) {
+			return fmt.Errorf("cannot build %s: invalid %s: %q", assertType.Name, p.name, p.value)
+		}
+	}
+	return nil
+}
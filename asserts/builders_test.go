@@ -0,0 +1,123 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+)
+
+type buildersSuite struct {
+	ts time.Time
+}
+
+var _ = Suite(&buildersSuite{})
+
+func (bs *buildersSuite) SetUpSuite(c *C) {
+	bs.ts = time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (bs *buildersSuite) snapDeclParams() asserts.SnapDeclarationParams {
+	return asserts.SnapDeclarationParams{
+		AuthorityID: "canonical",
+		Series:      "16",
+		SnapID:      "snap-id-1",
+		SnapName:    "first",
+		PublisherID: "dev-id1",
+		Gates:       []string{"snap-id-2", "snap-id-3"},
+		Timestamp:   bs.ts,
+	}
+}
+
+func (bs *buildersSuite) TestBuildSnapDeclaration(c *C) {
+	a, err := asserts.BuildSnapDeclaration(bs.snapDeclParams(), testPrivKey0)
+	c.Assert(err, IsNil)
+	snapDecl := a.(*asserts.SnapDeclaration)
+	c.Check(snapDecl.AuthorityID(), Equals, "canonical")
+	c.Check(snapDecl.Revision(), Equals, 0)
+	c.Check(snapDecl.Series(), Equals, "16")
+	c.Check(snapDecl.SnapID(), Equals, "snap-id-1")
+	c.Check(snapDecl.SnapName(), Equals, "first")
+	c.Check(snapDecl.PublisherID(), Equals, "dev-id1")
+	c.Check(snapDecl.Gates(), DeepEquals, []string{"snap-id-2", "snap-id-3"})
+	c.Check(snapDecl.Timestamp().Equal(bs.ts), Equals, true)
+
+	err = asserts.VerifyWithPublicKey(a, testPrivKey0.PublicKey())
+	c.Check(err, IsNil)
+}
+
+func (bs *buildersSuite) TestBuildSnapDeclarationInvalid(c *C) {
+	tests := []struct {
+		mutate      func(*asserts.SnapDeclarationParams)
+		expectedErr string
+	}{
+		{func(p *asserts.SnapDeclarationParams) { p.AuthorityID = "" }, `cannot build snap-declaration: authority-id is required`},
+		{func(p *asserts.SnapDeclarationParams) { p.Series = "" }, `cannot build snap-declaration: series is required`},
+		{func(p *asserts.SnapDeclarationParams) { p.Series = "sixteen" }, `cannot build snap-declaration: invalid series: "sixteen"`},
+		{func(p *asserts.SnapDeclarationParams) { p.SnapID = "" }, `cannot build snap-declaration: snap-id is required`},
+		{func(p *asserts.SnapDeclarationParams) { p.SnapID = "-snap/id" }, `cannot build snap-declaration: invalid snap-id: "-snap/id"`},
+		{func(p *asserts.SnapDeclarationParams) { p.SnapName = "" }, `cannot build snap-declaration: snap-name is required`},
+		{func(p *asserts.SnapDeclarationParams) { p.PublisherID = "" }, `cannot build snap-declaration: publisher-id is required`},
+		{func(p *asserts.SnapDeclarationParams) { p.Gates = []string{"snap id"} }, `cannot build snap-declaration: invalid snap-id in gates: "snap id"`},
+		{func(p *asserts.SnapDeclarationParams) { p.Timestamp = time.Time{} }, `cannot build snap-declaration: timestamp is required`},
+	}
+
+	for _, test := range tests {
+		params := bs.snapDeclParams()
+		test.mutate(&params)
+		_, err := asserts.BuildSnapDeclaration(params, testPrivKey0)
+		c.Check(err, ErrorMatches, test.expectedErr)
+	}
+}
+
+func (bs *buildersSuite) TestBuildSnapRevision(c *C) {
+	params := asserts.SnapRevisionParams{
+		AuthorityID:  "canonical",
+		Revision:     2,
+		Series:       "16",
+		SnapID:       "snap-id-1",
+		SnapDigest:   "sha512-abc",
+		SnapSize:     123,
+		SnapRevision: 1,
+		DeveloperID:  "dev-id1",
+		Timestamp:    bs.ts,
+	}
+	a, err := asserts.BuildSnapRevision(params, testPrivKey0)
+	c.Assert(err, IsNil)
+	snapRev := a.(*asserts.SnapRevision)
+	c.Check(snapRev.Revision(), Equals, 2)
+	c.Check(snapRev.SnapID(), Equals, "snap-id-1")
+	c.Check(snapRev.SnapDigest(), Equals, "sha512-abc")
+	c.Check(snapRev.SnapSize(), Equals, uint64(123))
+	c.Check(snapRev.SnapRevision(), Equals, uint64(1))
+	c.Check(snapRev.DeveloperID(), Equals, "dev-id1")
+
+	params.SnapRevision = 0
+	_, err = asserts.BuildSnapRevision(params, testPrivKey0)
+	c.Check(err, ErrorMatches, `cannot build snap-revision: snap-revision is required`)
+
+	params.SnapRevision = 1
+	params.DeveloperID = ""
+	_, err = asserts.BuildSnapRevision(params, testPrivKey0)
+	c.Check(err, ErrorMatches, `cannot build snap-revision: developer-id is required`)
+}
@@ -30,8 +30,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"time"
 
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
@@ -152,6 +155,41 @@ func (opgSig openpgpSignature) KeyID() string {
 	return fmt.Sprintf("%016x", *opgSig.sig.IssuerKeyId)
 }
 
+// signatureAlgorithm returns the name of the signature algorithm used
+// by sig, combining the names of its public key and hash algorithms,
+// e.g. "rsa-sha512".
+func signatureAlgorithm(sig Signature) string {
+	opgSig, ok := sig.(openpgpSignature)
+	if !ok {
+		panic(fmt.Errorf("not an internally supported Signature: %T", sig))
+	}
+	var pubKeyAlgo string
+	switch opgSig.sig.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+		pubKeyAlgo = "rsa"
+	case packet.PubKeyAlgoDSA:
+		pubKeyAlgo = "dsa"
+	case packet.PubKeyAlgoECDSA:
+		pubKeyAlgo = "ecdsa"
+	default:
+		pubKeyAlgo = fmt.Sprintf("pubkey%d", opgSig.sig.PubKeyAlgo)
+	}
+	var hashAlgo string
+	switch opgSig.sig.Hash {
+	case crypto.SHA1:
+		hashAlgo = "sha1"
+	case crypto.SHA256:
+		hashAlgo = "sha256"
+	case crypto.SHA384:
+		hashAlgo = "sha384"
+	case crypto.SHA512:
+		hashAlgo = "sha512"
+	default:
+		hashAlgo = fmt.Sprintf("hash%d", opgSig.sig.Hash)
+	}
+	return pubKeyAlgo + "-" + hashAlgo
+}
+
 func verifyContentSignature(content []byte, sig Signature, pubKey *packet.PublicKey) error {
 	opgSig, ok := sig.(openpgpSignature)
 	if !ok {
@@ -303,7 +341,9 @@ func OpenPGPPrivateKey(privk *packet.PrivateKey) PrivateKey {
 	return openpgpPrivateKey{privk}
 }
 
-// GenerateKey generates a private/public key pair.
+// GenerateKey generates a private/public key pair. The private key
+// can be used to sign assertions, for example by importing it into a
+// Database, and the public key to verify them.
 func GenerateKey() (PrivateKey, error) {
 	priv, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
@@ -316,6 +356,55 @@ func encodePrivateKey(privKey PrivateKey) ([]byte, error) {
 	return encodeKey(privKey, "private key")
 }
 
+// ExportPrivateKey serializes a private key for persisting it or
+// transferring it to another machine. The result is an ASCII armored
+// OpenPGP private key packet (block type "PGP PRIVATE KEY BLOCK"),
+// the private key material in it is not encrypted.
+func ExportPrivateKey(privKey PrivateKey) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot export private key: %v", err)
+	}
+	err = privKey.keyEncode(w)
+	if err != nil {
+		return nil, fmt.Errorf("cannot export private key: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot export private key: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportPrivateKey reads back a private key serialized with ExportPrivateKey.
+func ImportPrivateKey(exported []byte) (PrivateKey, error) {
+	blk, err := armor.Decode(bytes.NewReader(exported))
+	if err != nil {
+		return nil, fmt.Errorf("cannot import private key: %v", err)
+	}
+	if blk.Type != openpgp.PrivateKeyType {
+		return nil, fmt.Errorf("cannot import private key: unexpected armor type: %q", blk.Type)
+	}
+	// read everything to have the armor checksum verified
+	data, err := ioutil.ReadAll(blk.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot import private key: %v", err)
+	}
+	pkt, err := packet.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot import private key: %v", err)
+	}
+	privk, ok := pkt.(*packet.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("cannot import private key: expected private key, got instead: %T", pkt)
+	}
+	if privk.Encrypted {
+		return nil, fmt.Errorf("cannot import private key: encrypted private keys are not supported")
+	}
+	return openpgpPrivateKey{privk}, nil
+}
+
 // externally held key pairs
 
 type extPGPPrivateKey struct {
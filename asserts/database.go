@@ -24,7 +24,10 @@ package asserts
 import (
 	"errors"
 	"fmt"
+	"io"
 	"regexp"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -80,11 +83,24 @@ type DatabaseConfig struct {
 	KeypairManager KeypairManager
 	// assertion checkers used by Database.Check, left unset DefaultCheckers will be used which is recommended
 	Checkers []Checker
+	// PrimaryKeyCase controls how mixed-case values of the primary
+	// key headers expected in lowercase (e.g. account-id) are treated
+	// by Sign and Check, they are accepted as they are by default
+	PrimaryKeyCase PrimaryKeyCase
+	// Superseded, if set, is invoked by Database.Add after it has
+	// successfully replaced an assertion with a higher revision one
+	Superseded func(old, new Ref, oldRevision, newRevision int)
+	// AllowedSignatureAlgorithms, if set, lists the signature
+	// algorithms accepted by Database.Check, named after the public
+	// key and hash algorithms (e.g. "rsa-sha512"), by default any
+	// supported one is accepted
+	AllowedSignatureAlgorithms []string
 }
 
 // Well-known errors
 var (
 	ErrNotFound = errors.New("assertion not found")
+	ErrPinned   = errors.New("assertion is pinned, cannot supersede it")
 )
 
 // RevisionError indicates a revision improperly used for an operation.
@@ -106,6 +122,35 @@ func (e *RevisionError) Error() string {
 	return fmt.Sprintf("revision %d is more recent than current revision %d", e.Used, e.Current)
 }
 
+// SigningKeyNotFoundError indicates that the account-key matching
+// the key that signed an assertion could not be found.
+type SigningKeyNotFoundError struct {
+	AuthorityID, KeyID string
+}
+
+func (e *SigningKeyNotFoundError) Error() string {
+	return fmt.Sprintf("no matching public key %q for signature by %q", e.KeyID, e.AuthorityID)
+}
+
+// SignatureError indicates that an assertion signature failed verification.
+type SignatureError struct {
+	Err error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("failed signature verification: %v", e.Err)
+}
+
+// SignatureAlgorithmError indicates that an assertion was signed with a
+// signature algorithm that is not allowed.
+type SignatureAlgorithmError struct {
+	Algorithm string
+}
+
+func (e *SignatureAlgorithmError) Error() string {
+	return fmt.Sprintf("signature algorithm %q is not allowed", e.Algorithm)
+}
+
 // A RODatabase exposes read-only access to an assertion database.
 type RODatabase interface {
 	// IsTrustedAccount returns whether the account is part of the trusted set.
@@ -132,6 +177,19 @@ type Database struct {
 	trusted    Backstore
 	backstores []Backstore
 	checkers   []Checker
+	superseded func(old, new Ref, oldRevision, newRevision int)
+	keyCase    PrimaryKeyCase
+
+	allowedSigAlgos map[string]bool
+
+	pinMu  sync.RWMutex
+	pinned map[string]bool
+
+	provMu     sync.RWMutex
+	provenance map[string]Provenance
+
+	// serializes checking and storing of added assertions
+	addMu sync.Mutex
 }
 
 // OpenDatabase opens the assertion database based on the configuration.
@@ -175,6 +233,14 @@ func OpenDatabase(cfg *DatabaseConfig) (*Database, error) {
 	dbCheckers := make([]Checker, len(checkers))
 	copy(dbCheckers, checkers)
 
+	var allowedSigAlgos map[string]bool
+	if cfg.AllowedSignatureAlgorithms != nil {
+		allowedSigAlgos = make(map[string]bool, len(cfg.AllowedSignatureAlgorithms))
+		for _, algo := range cfg.AllowedSignatureAlgorithms {
+			allowedSigAlgos[algo] = true
+		}
+	}
+
 	return &Database{
 		bs:         bs,
 		keypairMgr: keypairMgr,
@@ -184,6 +250,12 @@ func OpenDatabase(cfg *DatabaseConfig) (*Database, error) {
 		// general backstore!
 		backstores: []Backstore{trustedBackstore, bs},
 		checkers:   dbCheckers,
+		superseded: cfg.Superseded,
+		keyCase:    cfg.PrimaryKeyCase,
+		pinned:     make(map[string]bool),
+		provenance: make(map[string]Provenance),
+
+		allowedSigAlgos: allowedSigAlgos,
 	}, nil
 }
 
@@ -227,6 +299,12 @@ func (db *Database) Sign(assertType *AssertionType, headers map[string]string, b
 	if err != nil {
 		return nil, err
 	}
+	if assertType != nil {
+		headers, err = checkPrimaryKeyCase(assertType, headers, db.keyCase)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return assembleAndSign(assertType, headers, body, privKey)
 }
 
@@ -257,15 +335,27 @@ func (db *Database) IsTrustedAccount(accountID string) bool {
 
 // Check tests whether the assertion is properly signed and consistent with all the stored knowledge.
 func (db *Database) Check(assert Assertion) error {
+	if db.keyCase != IgnorePrimaryKeyCase {
+		// signed content cannot be normalized anymore
+		if _, err := checkPrimaryKeyCase(assert.Type(), assert.Headers(), RejectMixedCasePrimaryKeys); err != nil {
+			return err
+		}
+	}
 	_, signature := assert.Signature()
 	sig, err := decodeSignature(signature)
 	if err != nil {
 		return err
 	}
+	if db.allowedSigAlgos != nil {
+		algo := signatureAlgorithm(sig)
+		if !db.allowedSigAlgos[algo] {
+			return &SignatureAlgorithmError{Algorithm: algo}
+		}
+	}
 	// TODO: later may need to consider type of assert to find candidate keys
 	accKey, err := db.findAccountKey(assert.AuthorityID(), sig.KeyID())
 	if err == ErrNotFound {
-		return fmt.Errorf("no matching public key %q for signature by %q", sig.KeyID(), assert.AuthorityID())
+		return &SigningKeyNotFoundError{AuthorityID: assert.AuthorityID(), KeyID: sig.KeyID()}
 	}
 	if err != nil {
 		return fmt.Errorf("error finding matching public key for signature: %v", err)
@@ -285,7 +375,39 @@ func (db *Database) Check(assert Assertion) error {
 // Add persists the assertion after ensuring it is properly signed and consistent with all the stored knowledge.
 // It will return an error when trying to add an older revision of the assertion than the one currently stored.
 func (db *Database) Add(assert Assertion) error {
+	db.addMu.Lock()
+	defer db.addMu.Unlock()
+	return db.add(assert)
+}
+
+// VerifyAndAdd is like Add but it first checks that the whole chain
+// needed to verify the assertion, its signing account-key and any
+// other prerequisites, is already present in the database. The check
+// of the chain, of the signature and the supersession rules are all
+// applied under one lock, so that the database is left unchanged if
+// any of them fail.
+func (db *Database) VerifyAndAdd(assert Assertion) error {
+	db.addMu.Lock()
+	defer db.addMu.Unlock()
+	if err := checkAssertType(assert.Type()); err != nil {
+		return err
+	}
+	missing, err := Prerequisites(assert, db)
+	if err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("cannot add %s: missing prerequisite assertion %s", assert.Ref().Unique(), missing[0].Unique())
+	}
+	return db.add(assert)
+}
+
+func (db *Database) add(assert Assertion) error {
 	assertType := assert.Type()
+	// opaque assertions of unknown types cannot be stored
+	if err := checkAssertType(assertType); err != nil {
+		return err
+	}
 	err := db.Check(assert)
 	if err != nil {
 		return err
@@ -308,7 +430,227 @@ func (db *Database) Add(assert Assertion) error {
 		return fmt.Errorf("cannot add %q assertion with primary key clashing with a trusted assertion: %v", assertType.Name, keyValues)
 	}
 
-	return db.bs.Put(assertType, assert)
+	cur, err := db.bs.Get(assertType, keyValues)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if cur != nil && db.isPinned(assert.Ref()) && assert.Revision() > cur.Revision() {
+		return ErrPinned
+	}
+
+	// the caller can release an assertion borrowing its backing
+	// bytes from a pool, keep a copy owning them instead
+	assert, err = ownedAssertion(assert)
+	if err != nil {
+		return err
+	}
+	err = db.bs.Put(assertType, assert)
+	if err != nil {
+		return err
+	}
+	// any provenance was about the superseded revision
+	db.setProvenance(assert.Ref(), nil)
+	if cur != nil && db.superseded != nil {
+		db.superseded(cur.Ref(), assert.Ref(), cur.Revision(), assert.Revision())
+	}
+	return nil
+}
+
+// Provenance records where an assertion added to the database came
+// from. It is kept only in memory alongside the assertion and never
+// affects its verification or encoding.
+type Provenance struct {
+	// Origin identifies the source of the assertion, e.g. the
+	// remote it was fetched from.
+	Origin string
+	// Fetched is when the assertion was obtained from Origin.
+	Fetched time.Time
+}
+
+// AddWithProvenance is like Add but on success it also records prov
+// as the provenance of the added assertion, retrievable with
+// Provenance. Adding a newer revision of the assertion later drops
+// the recorded provenance.
+func (db *Database) AddWithProvenance(assert Assertion, prov Provenance) error {
+	db.addMu.Lock()
+	defer db.addMu.Unlock()
+	if err := db.add(assert); err != nil {
+		return err
+	}
+	db.setProvenance(assert.Ref(), &prov)
+	return nil
+}
+
+// Provenance returns the provenance recorded with AddWithProvenance
+// for the currently stored revision of the referenced assertion, if
+// any.
+func (db *Database) Provenance(ref Ref) (prov Provenance, ok bool) {
+	db.provMu.RLock()
+	defer db.provMu.RUnlock()
+	prov, ok = db.provenance[ref.Unique()]
+	return prov, ok
+}
+
+func (db *Database) setProvenance(ref Ref, prov *Provenance) {
+	db.provMu.Lock()
+	defer db.provMu.Unlock()
+	if prov == nil {
+		delete(db.provenance, ref.Unique())
+		return
+	}
+	db.provenance[ref.Unique()] = *prov
+}
+
+// Pin pins the currently stored revision of the referenced
+// assertion: until unpinned, Add will refuse to supersede it with a
+// newer revision returning ErrPinned.
+func (db *Database) Pin(ref Ref) {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	db.pinned[ref.Unique()] = true
+}
+
+// Unpin undoes Pin for the referenced assertion.
+func (db *Database) Unpin(ref Ref) {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	delete(db.pinned, ref.Unique())
+}
+
+func (db *Database) isPinned(ref Ref) bool {
+	db.pinMu.RLock()
+	defer db.pinMu.RUnlock()
+	return db.pinned[ref.Unique()]
+}
+
+// SaveTo writes all the assertions held in the database backstore,
+// trusted ones excluded, as a single stream to w. They are emitted in
+// a deterministic order, the canonical one of CompareRefs: by type name
+// and then lexicographically by primary key values.
+func (db *Database) SaveTo(w io.Writer) error {
+	typeNames := make([]string, 0, len(typeRegistry))
+	for name := range typeRegistry {
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+
+	enc := NewBufferedEncoder(w)
+	for _, name := range typeNames {
+		var found []Assertion
+		err := db.bs.Search(typeRegistry[name], nil, func(a Assertion) {
+			found = append(found, a)
+		})
+		if err != nil {
+			return err
+		}
+		sort.Sort(byPrimaryKey(found))
+		for _, a := range found {
+			if err := enc.Encode(a); err != nil {
+				return err
+			}
+		}
+	}
+	return enc.Flush()
+}
+
+// RefsWithRevisions returns the revisions of the assertions held in
+// the database backstore, trusted ones excluded, keyed by the
+// assertion type name followed by the primary key values, all
+// separated by "/", e.g. "account/acc-id1". Refs themselves are not
+// usable as map keys. The returned map is a snapshot owned by the
+// caller, it is not affected by later changes to the database. A
+// client can send it to a server to receive only newer assertions.
+func (db *Database) RefsWithRevisions() (map[string]int, error) {
+	revisions := make(map[string]int)
+	for _, assertType := range typeRegistry {
+		err := db.bs.Search(assertType, nil, func(a Assertion) {
+			revisions[a.Ref().Unique()] = a.Revision()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+type byPrimaryKey []Assertion
+
+func (b byPrimaryKey) Len() int           { return len(b) }
+func (b byPrimaryKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPrimaryKey) Less(i, j int) bool { return CompareRefs(b[i].Ref(), b[j].Ref()) < 0 }
+
+// LoadFrom adds all the assertions in the stream read from r, as
+// written by SaveTo, to the database. The stream is read whole first
+// and its assertions are added after the ones in it they depend on,
+// whatever their order in the stream. Assertions that are not newer
+// than the ones already present are skipped.
+func (db *Database) LoadFrom(r io.Reader) error {
+	var assertions []Assertion
+	dec := NewDecoder(r)
+	for {
+		a, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		assertions = append(assertions, a)
+	}
+	ordered, err := orderByPrerequisites(assertions)
+	if err != nil {
+		return err
+	}
+	for _, a := range ordered {
+		err = db.Add(a)
+		if _, ok := err.(*RevisionError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderByPrerequisites returns the assertions reordered so that the
+// prerequisites among them of each one come before it, otherwise
+// keeping their relative order.
+func orderByPrerequisites(assertions []Assertion) ([]Assertion, error) {
+	byRef := make(map[string]Assertion, len(assertions))
+	for _, a := range assertions {
+		byRef[a.Ref().Unique()] = a
+	}
+	ordered := make([]Assertion, 0, len(assertions))
+	visited := make(map[string]bool, len(assertions))
+	var visit func(a Assertion) error
+	visit = func(a Assertion) error {
+		u := a.Ref().Unique()
+		if visited[u] {
+			// done or in progress, a cycle is left for Add to reject
+			return nil
+		}
+		visited[u] = true
+		refs, err := prerequisiteRefs(a)
+		if err != nil {
+			return fmt.Errorf("cannot load assertion %s: %v", u, err)
+		}
+		for _, ref := range refs {
+			if prereq, ok := byRef[ref.Unique()]; ok {
+				if err := visit(prereq); err != nil {
+					return err
+				}
+			}
+		}
+		ordered = append(ordered, a)
+		return nil
+	}
+	for _, a := range assertions {
+		if err := visit(a); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
 }
 
 func searchMatch(assert Assertion, expectedHeaders map[string]string) bool {
@@ -357,6 +699,13 @@ func (db *Database) Find(assertionType *AssertionType, headers map[string]string
 	return assert, nil
 }
 
+// FindRevisioned finds the assertion referenced by ref. If ref pins a
+// revision it returns ErrNotFound unless exactly that revision is the
+// one held.
+func (db *Database) FindRevisioned(ref RevisionedRef) (Assertion, error) {
+	return ref.find(db)
+}
+
 // FindMany finds assertions based on arbitrary headers.
 // It returns ErrNotFound if no assertion can be found.
 func (db *Database) FindMany(assertionType *AssertionType, headers map[string]string) ([]Assertion, error) {
@@ -383,6 +732,18 @@ func (db *Database) FindMany(assertionType *AssertionType, headers map[string]st
 	return res, nil
 }
 
+// FindBy finds all the assertions of the given type whose header has
+// the given value, which is meant for non-primary headers, e.g. all
+// the snap-declarations of a publisher. For those the backstores
+// resort to a linear scan over the assertions of the type, while a
+// primary key header is used as a hint to narrow the search. It
+// returns ErrNotFound if nothing matches.
+func (db *Database) FindBy(assertionType *AssertionType, header, value string) ([]Assertion, error) {
+	return db.FindMany(assertionType, map[string]string{
+		header: value,
+	})
+}
+
 // assertion checkers
 
 // CheckSigningKeyIsNotExpired checks that the signing key is not expired.
@@ -395,10 +756,220 @@ func CheckSigningKeyIsNotExpired(assert Assertion, signature Signature, signingK
 
 // CheckSignature checks that the signature is valid.
 func CheckSignature(assert Assertion, signature Signature, signingKey *AccountKey, roDB RODatabase, checkTime time.Time) error {
+	pubKey, err := signingKey.PublicKey()
+	if err != nil {
+		return err
+	}
 	content, _ := assert.Signature()
-	err := signingKey.publicKey().verify(content, signature)
+	err = pubKey.verify(content, signature)
+	if err != nil {
+		return &SignatureError{Err: err}
+	}
+	return nil
+}
+
+// CheckSignatureAgainstStore checks the signature of the assertion
+// using the matching account-key, by authority-id and signing key id,
+// held in the given backstore. It returns a *SigningKeyNotFoundError
+// if there is no such account-key and a *SignatureError if the
+// signature does not verify.
+func CheckSignatureAgainstStore(assert Assertion, bs Backstore) error {
+	_, signature := assert.Signature()
+	sig, err := decodeSignature(signature)
+	if err != nil {
+		return err
+	}
+	a, err := bs.Get(AccountKeyType, []string{assert.AuthorityID(), sig.KeyID()})
+	if err == ErrNotFound {
+		return &SigningKeyNotFoundError{AuthorityID: assert.AuthorityID(), KeyID: sig.KeyID()}
+	}
+	if err != nil {
+		return fmt.Errorf("error finding matching public key for signature: %v", err)
+	}
+	return CheckSignature(assert, sig, a.(*AccountKey), nil, time.Time{})
+}
+
+// VerifyingDecoder decodes a stream of assertions like a Decoder but
+// also checks the signature of each against the account-keys held in
+// a trusted backstore, never returning assertions that do not verify.
+type VerifyingDecoder struct {
+	dec     *Decoder
+	trusted Backstore
+}
+
+// NewVerifyingDecoder returns a VerifyingDecoder to parse and verify
+// the stream of assertions from the reader using the account-keys in
+// the trusted backstore.
+func NewVerifyingDecoder(r io.Reader, trusted Backstore) *VerifyingDecoder {
+	return &VerifyingDecoder{
+		dec:     NewDecoder(r),
+		trusted: trusted,
+	}
+}
+
+// Decode parses the next assertion from the stream and checks its
+// signature. It returns the error io.EOF at the end of a well-formed
+// stream, otherwise the errors of Decoder.Decode or of
+// CheckSignatureAgainstStore.
+func (vd *VerifyingDecoder) Decode() (Assertion, error) {
+	a, err := vd.dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+	err = CheckSignatureAgainstStore(a, vd.trusted)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (ref Ref) find(db RODatabase) (Assertion, error) {
+	headers := make(map[string]string, len(ref.PrimaryKey))
+	for i, name := range ref.Type.PrimaryKey {
+		headers[name] = ref.PrimaryKey[i]
+	}
+	return db.Find(ref.Type, headers)
+}
+
+func (ref RevisionedRef) find(db RODatabase) (Assertion, error) {
+	a, err := ref.Ref.find(db)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Revision != AnyRevision && a.Revision() != ref.Revision {
+		return nil, ErrNotFound
+	}
+	return a, nil
+}
+
+// prerequisitesProvider is implemented by assertions that need
+// other assertions, besides the signing account-key, to be present
+// for their consistency checks.
+type prerequisitesProvider interface {
+	prerequisites() []Ref
+}
+
+// Prerequisites returns references to the assertions that are needed
+// to verify the leaf assertion, its signing account-key and any
+// accounts or other assertions its consistency checks require, and
+// that are not yet present in db.
+func Prerequisites(leaf Assertion, db RODatabase) ([]Ref, error) {
+	refs, err := prerequisiteRefs(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []Ref
+	for _, ref := range refs {
+		_, err := ref.find(db)
+		if err == ErrNotFound {
+			missing = append(missing, ref)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// prerequisiteRefs returns references to the signing account-key of
+// leaf and to the other assertions its consistency checks require.
+func prerequisiteRefs(leaf Assertion) ([]Ref, error) {
+	_, signature := leaf.Signature()
+	sig, err := decodeSignature(signature)
 	if err != nil {
-		return fmt.Errorf("failed signature verification: %v", err)
+		return nil, err
+	}
+	refs := []Ref{{Type: AccountKeyType, PrimaryKey: []string{leaf.AuthorityID(), sig.KeyID()}}}
+	if provider, ok := leaf.(prerequisitesProvider); ok {
+		refs = append(refs, provider.prerequisites()...)
+	}
+	return refs, nil
+}
+
+// CheckOrdered checks in a single pass that the stream of assertions
+// from r is ordered so that the prerequisites of each assertion, its
+// signing account-key and any other assertion its consistency checks
+// require, appear before it, so that it can be verified while being
+// read. Prerequisites not in the stream at all, e.g. trusted keys, are
+// assumed to be provided otherwise. It reports the first assertion
+// found to appear before one of its prerequisites.
+func CheckOrdered(r io.Reader) error {
+	seen := make(map[string]bool)
+	// prerequisites not seen yet and their first dependent
+	pending := make(map[string]string)
+	d := NewDecoder(r)
+	for {
+		a, err := d.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		u := a.Ref().Unique()
+		if dependent, ok := pending[u]; ok {
+			return fmt.Errorf("stream is not ordered: %s appears before %s it depends on", dependent, u)
+		}
+		seen[u] = true
+		refs, err := prerequisiteRefs(a)
+		if err != nil {
+			return fmt.Errorf("cannot check stream assertion %s: %v", u, err)
+		}
+		for _, ref := range refs {
+			ru := ref.Unique()
+			if seen[ru] {
+				continue
+			}
+			if _, ok := pending[ru]; !ok {
+				pending[ru] = u
+			}
+		}
+	}
+}
+
+// ValidateBundle checks offline that the assertions form a
+// self-consistent set: each of them must be signed either by one of
+// the trusted public keys or by an account-key included in the
+// bundle, their signatures must verify, and the assertions they
+// reference must be included as well. It reports the first
+// inconsistency found.
+func ValidateBundle(assertions []Assertion, trusted []PublicKey) error {
+	bs := NewMemoryBackstore()
+	for _, a := range assertions {
+		if err := bs.Put(a.Type(), a); err != nil {
+			return fmt.Errorf("cannot index bundle assertion %s: %v", a.Ref().Unique(), err)
+		}
+	}
+	trustedKeys := make(map[string]PublicKey, len(trusted))
+	for _, pubKey := range trusted {
+		trustedKeys[pubKey.ID()] = pubKey
+	}
+
+	for _, a := range assertions {
+		content, signature := a.Signature()
+		sig, err := decodeSignature(signature)
+		if err != nil {
+			return fmt.Errorf("invalid signature of bundle assertion %s: %v", a.Ref().Unique(), err)
+		}
+		if pubKey := trustedKeys[sig.KeyID()]; pubKey != nil {
+			if err := pubKey.verify(content, sig); err != nil {
+				return fmt.Errorf("bundle assertion %s: %v", a.Ref().Unique(), &SignatureError{Err: err})
+			}
+		} else if err := CheckSignatureAgainstStore(a, bs); err != nil {
+			return fmt.Errorf("bundle assertion %s: %v", a.Ref().Unique(), err)
+		}
+
+		provider, ok := a.(prerequisitesProvider)
+		if !ok {
+			continue
+		}
+		for _, ref := range provider.prerequisites() {
+			if _, err := bs.Get(ref.Type, ref.PrimaryKey); err != nil {
+				return fmt.Errorf("bundle is missing assertion %s referenced by %s", ref.Unique(), a.Ref().Unique())
+			}
+		}
 	}
 	return nil
 }
@@ -407,13 +978,38 @@ type timestamped interface {
 	Timestamp() time.Time
 }
 
+// assertionTime returns the time the assertion claims to have been
+// made at: its parsed timestamp or, for types without one, its
+// "timestamp" header if it carries one. ok is false if it has none.
+func assertionTime(assert Assertion) (t time.Time, ok bool, err error) {
+	if tstamped, ok := assert.(timestamped); ok {
+		return tstamped.Timestamp(), true, nil
+	}
+	if assert.Header("timestamp") == "" {
+		return time.Time{}, false, nil
+	}
+	t, err = Timestamp(assert)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
 // CheckTimestampVsSigningKeyValidity verifies that the timestamp of
-// the assertion is within the signing key validity.
+// the assertion is within the signing key validity, so that a key
+// valid now cannot vouch for assertions claiming to be made outside
+// of its validity. Types without a parsed timestamp are checked
+// against their "timestamp" header if they carry one.
 func CheckTimestampVsSigningKeyValidity(assert Assertion, signature Signature, signingKey *AccountKey, roDB RODatabase, checkTime time.Time) error {
-	if tstamped, ok := assert.(timestamped); ok {
-		if !signingKey.isKeyValidAt(tstamped.Timestamp()) {
-			return fmt.Errorf("%s assertion timestamp outside of signing key validity", assert.Type().Name)
-		}
+	timestamp, ok, err := assertionTime(assert)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	if !signingKey.isKeyValidAt(timestamp) {
+		return fmt.Errorf("%s assertion timestamp outside of signing key validity", assert.Type().Name)
 	}
 	return nil
 }
@@ -435,6 +1031,20 @@ func CheckCrossConsistency(assert Assertion, signature Signature, signingKey *Ac
 	return nil
 }
 
+// CheckDelegationConstraints checks that the delegation constraints of
+// the signing key permit it to sign the assertion, at the time of its
+// timestamp if it has one, otherwise at checkTime.
+func CheckDelegationConstraints(assert Assertion, signature Signature, signingKey *AccountKey, roDB RODatabase, checkTime time.Time) error {
+	at, ok, err := assertionTime(assert)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		at = checkTime
+	}
+	return CheckDelegation(signingKey, assert.Type(), at)
+}
+
 // DefaultCheckers lists the default and recommended assertion
 // checkers used by Database if none are specified in the
 // DatabaseConfig.Checkers.
@@ -442,5 +1052,6 @@ var DefaultCheckers = []Checker{
 	CheckSigningKeyIsNotExpired,
 	CheckSignature,
 	CheckTimestampVsSigningKeyValidity,
+	CheckDelegationConstraints,
 	CheckCrossConsistency,
 }
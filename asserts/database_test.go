@@ -24,10 +24,13 @@ import (
 	"crypto"
 	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -243,6 +246,45 @@ func (chks *checkSuite) TestCheckExpiredPubKey(c *C) {
 	c.Assert(err, ErrorMatches, `assertion is signed with expired public key "[a-f0-9]+" from "canonical"`)
 }
 
+func (chks *checkSuite) TestCheckTimestampHeaderVsSigningKeyValidity(c *C) {
+	storeDB, db := makeStoreAndCheckDB(c)
+
+	for _, t := range []struct {
+		timestamp string
+		err       string
+	}{
+		// within the store key validity
+		{time.Now().Format(time.RFC3339), ""},
+		// before the store key validity
+		{"2011-01-01T14:00:00Z", "test-only assertion timestamp outside of signing key validity"},
+		// after the store key validity
+		{time.Now().AddDate(10, 0, 0).Format(time.RFC3339), "test-only assertion timestamp outside of signing key validity"},
+		{"12:30", `assertion test-only: "timestamp" header is not a RFC3339 date: .*`},
+	} {
+		a, err := storeDB.Sign(asserts.TestOnlyType, map[string]string{
+			"authority-id": "canonical",
+			"primary-key":  "0",
+			"timestamp":    t.timestamp,
+		}, nil, "")
+		c.Assert(err, IsNil)
+
+		err = db.Check(a)
+		if t.err == "" {
+			c.Check(err, IsNil, Commentf("timestamp %s", t.timestamp))
+		} else {
+			c.Check(err, ErrorMatches, t.err, Commentf("timestamp %s", t.timestamp))
+		}
+	}
+
+	// assertions without a timestamp are not constrained
+	a, err := storeDB.Sign(asserts.TestOnlyType, map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "0",
+	}, nil, "")
+	c.Assert(err, IsNil)
+	c.Check(db.Check(a), IsNil)
+}
+
 func (chks *checkSuite) TestCheckForgery(c *C) {
 	trustedKey := testPrivKey0
 
@@ -279,6 +321,329 @@ func (chks *checkSuite) TestCheckForgery(c *C) {
 	c.Assert(err, ErrorMatches, "failed signature verification: .*")
 }
 
+func (chks *checkSuite) TestCheckAllowedSignatureAlgorithm(c *C) {
+	cfg := &asserts.DatabaseConfig{
+		Backstore:      chks.bs,
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        []asserts.Assertion{asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey())},
+
+		AllowedSignatureAlgorithms: []string{"rsa-sha512"},
+	}
+	db, err := asserts.OpenDatabase(cfg)
+	c.Assert(err, IsNil)
+
+	err = db.Check(chks.a)
+	c.Check(err, IsNil)
+}
+
+func (chks *checkSuite) TestCheckDisallowedSignatureAlgorithm(c *C) {
+	trusted := []asserts.Assertion{asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey())}
+
+	// re-sign with the deprecated SHA256
+	encoded := asserts.Encode(chks.a)
+	content, encodedSig := chks.a.Signature()
+	privKeyPkt := asserts.PrivateKeyPacket(testPrivKey0)
+	sig := new(packet.Signature)
+	sig.PubKeyAlgo = privKeyPkt.PubKeyAlgo
+	sig.Hash = crypto.SHA256
+	sig.CreationTime = time.Now()
+	sig.IssuerKeyId = &privKeyPkt.KeyId
+	h := crypto.SHA256.New()
+	h.Write(content)
+	err := sig.Sign(h, privKeyPkt, &packet.Config{DefaultHash: crypto.SHA256})
+	c.Assert(err, IsNil)
+	buf := new(bytes.Buffer)
+	sig.Serialize(buf)
+	sha256SigEncoded := "openpgp " + base64.StdEncoding.EncodeToString(buf.Bytes())
+	sha256Assert, err := asserts.Decode(bytes.Replace(encoded, encodedSig, []byte(sha256SigEncoded), 1))
+	c.Assert(err, IsNil)
+
+	// the signature itself verifies
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      chks.bs,
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        trusted,
+	})
+	c.Assert(err, IsNil)
+	err = db.Check(sha256Assert)
+	c.Assert(err, IsNil)
+
+	db, err = asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      chks.bs,
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        trusted,
+
+		AllowedSignatureAlgorithms: []string{"rsa-sha512"},
+	})
+	c.Assert(err, IsNil)
+	err = db.Check(sha256Assert)
+	c.Assert(err, FitsTypeOf, &asserts.SignatureAlgorithmError{})
+	c.Check(err, ErrorMatches, `signature algorithm "rsa-sha256" is not allowed`)
+}
+
+func (chks *checkSuite) TestCheckSignatureAgainstStore(c *C) {
+	bs := asserts.NewMemoryBackstore()
+	err := bs.Put(asserts.AccountKeyType, asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey()))
+	c.Assert(err, IsNil)
+
+	err = asserts.CheckSignatureAgainstStore(chks.a, bs)
+	c.Check(err, IsNil)
+}
+
+func (chks *checkSuite) TestCheckSignatureAgainstStoreKeyNotFound(c *C) {
+	bs := asserts.NewMemoryBackstore()
+	err := bs.Put(asserts.AccountKeyType, asserts.BootstrapAccountKeyForTest("canonical", testPrivKey1.PublicKey()))
+	c.Assert(err, IsNil)
+
+	err = asserts.CheckSignatureAgainstStore(chks.a, bs)
+	c.Assert(err, FitsTypeOf, &asserts.SigningKeyNotFoundError{})
+	c.Check(err, DeepEquals, &asserts.SigningKeyNotFoundError{
+		AuthorityID: "canonical",
+		KeyID:       testPrivKey0.PublicKey().ID(),
+	})
+	c.Check(err, ErrorMatches, `no matching public key "[a-f0-9]+" for signature by "canonical"`)
+}
+
+func (chks *checkSuite) TestCheckSignatureAgainstStoreInvalidSignature(c *C) {
+	bs := asserts.NewMemoryBackstore()
+	err := bs.Put(asserts.AccountKeyType, asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey()))
+	c.Assert(err, IsNil)
+
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "1",
+	}
+	other, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey0)
+	c.Assert(err, IsNil)
+
+	// content of chks.a with the signature of other
+	content, _ := chks.a.Signature()
+	_, otherSig := other.Signature()
+	mismatched, err := asserts.Assemble(chks.a.Headers(), nil, content, otherSig)
+	c.Assert(err, IsNil)
+
+	err = asserts.CheckSignatureAgainstStore(mismatched, bs)
+	c.Assert(err, FitsTypeOf, &asserts.SignatureError{})
+	c.Check(err, ErrorMatches, "failed signature verification: .*")
+}
+
+func (chks *checkSuite) TestVerifyingDecoder(c *C) {
+	bs := asserts.NewMemoryBackstore()
+	err := bs.Put(asserts.AccountKeyType, asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey()))
+	c.Assert(err, IsNil)
+
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "1",
+	}
+	other, err := asserts.AssembleAndSignInTest(asserts.TestOnlyType, headers, nil, testPrivKey0)
+	c.Assert(err, IsNil)
+
+	// content of chks.a with the signature of other
+	content, _ := chks.a.Signature()
+	_, otherSig := other.Signature()
+	tampered, err := asserts.Assemble(chks.a.Headers(), nil, content, otherSig)
+	c.Assert(err, IsNil)
+
+	stream := new(bytes.Buffer)
+	enc := asserts.NewEncoder(stream)
+	c.Assert(enc.Encode(chks.a), IsNil)
+	c.Assert(enc.Encode(tampered), IsNil)
+	c.Assert(enc.Encode(other), IsNil)
+
+	vd := asserts.NewVerifyingDecoder(stream, bs)
+
+	a, err := vd.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Headers(), DeepEquals, chks.a.Headers())
+
+	a, err = vd.Decode()
+	c.Check(a, IsNil)
+	c.Assert(err, FitsTypeOf, &asserts.SignatureError{})
+	c.Check(err, ErrorMatches, "failed signature verification: .*")
+
+	a, err = vd.Decode()
+	c.Assert(err, IsNil)
+	c.Check(a.Header("primary-key"), Equals, "1")
+
+	_, err = vd.Decode()
+	c.Check(err, Equals, io.EOF)
+}
+
+func (chks *checkSuite) TestVerifyingDecoderKeyNotFound(c *C) {
+	bs := asserts.NewMemoryBackstore()
+
+	vd := asserts.NewVerifyingDecoder(bytes.NewReader(asserts.Encode(chks.a)), bs)
+
+	a, err := vd.Decode()
+	c.Check(a, IsNil)
+	c.Check(err, FitsTypeOf, &asserts.SigningKeyNotFoundError{})
+}
+
+func (chks *checkSuite) TestPrerequisites(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        store.Trusted,
+	})
+	c.Assert(err, IsNil)
+
+	storeKey := store.StoreAccountKey("")
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+
+	// missing the store account-key
+	refs, err := asserts.Prerequisites(acct, db)
+	c.Assert(err, IsNil)
+	c.Check(refs, DeepEquals, []asserts.Ref{
+		{Type: asserts.AccountKeyType, PrimaryKey: []string{"canonical", storeKey.PublicKeyID()}},
+	})
+
+	// signed by a trusted key
+	refs, err = asserts.Prerequisites(storeKey, db)
+	c.Assert(err, IsNil)
+	c.Check(refs, HasLen, 0)
+
+	err = db.Add(storeKey)
+	c.Assert(err, IsNil)
+	refs, err = asserts.Prerequisites(acct, db)
+	c.Assert(err, IsNil)
+	c.Check(refs, HasLen, 0)
+
+	// missing the account of the key
+	accKey := assertstest.NewAccountKey(store, acct, nil, testPrivKey2.PublicKey(), "")
+	refs, err = asserts.Prerequisites(accKey, db)
+	c.Assert(err, IsNil)
+	c.Check(refs, DeepEquals, []asserts.Ref{
+		{Type: asserts.AccountType, PrimaryKey: []string{acct.AccountID()}},
+	})
+}
+
+func encodeStream(c *C, assertions ...asserts.Assertion) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	enc := asserts.NewEncoder(buf)
+	for _, a := range assertions {
+		err := enc.Encode(a)
+		c.Assert(err, IsNil)
+	}
+	return buf
+}
+
+func (chks *checkSuite) TestCheckOrdered(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+
+	storeKey := store.StoreAccountKey("")
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, nil, testPrivKey2.PublicKey(), "")
+
+	// the trusted key is not part of the stream
+	err := asserts.CheckOrdered(encodeStream(c, store.TrustedAccount, storeKey, acct, accKey))
+	c.Check(err, IsNil)
+
+	err = asserts.CheckOrdered(encodeStream(c))
+	c.Check(err, IsNil)
+}
+
+func (chks *checkSuite) TestCheckOrderedReversed(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+
+	storeKey := store.StoreAccountKey("")
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, nil, testPrivKey2.PublicKey(), "")
+
+	err := asserts.CheckOrdered(encodeStream(c, accKey, acct, storeKey, store.TrustedAccount))
+	c.Check(err, ErrorMatches, fmt.Sprintf(`stream is not ordered: account-key/%[1]s/%s appears before account/%[1]s it depends on`, acct.AccountID(), accKey.PublicKeyID()))
+
+	// account-key signing the account after it
+	err = asserts.CheckOrdered(encodeStream(c, store.TrustedAccount, acct, storeKey))
+	c.Check(err, ErrorMatches, fmt.Sprintf(`stream is not ordered: account/%s appears before account-key/canonical/%s it depends on`, acct.AccountID(), storeKey.PublicKeyID()))
+}
+
+func (chks *checkSuite) TestLoadFromReordered(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+
+	storeKey := store.StoreAccountKey("")
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, nil, testPrivKey2.PublicKey(), "")
+	devDB := assertstest.NewSigningDB(acct.AccountID(), testPrivKey2)
+	a, err := devDB.Sign(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        store.Trusted,
+	})
+	c.Assert(err, IsNil)
+
+	// every assertion appears before the ones it depends on
+	err = db.LoadFrom(encodeStream(c, a, accKey, acct, storeKey))
+	c.Assert(err, IsNil)
+
+	for _, expected := range []asserts.Assertion{storeKey, acct, accKey, a} {
+		headers := make(map[string]string)
+		for _, k := range expected.Type().PrimaryKey {
+			headers[k] = expected.Header(k)
+		}
+		loaded, err := db.Find(expected.Type(), headers)
+		c.Assert(err, IsNil)
+		c.Check(loaded.Revision(), Equals, expected.Revision())
+	}
+}
+
+func (chks *checkSuite) TestValidateBundle(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	trusted := []asserts.PublicKey{testPrivKey0.PublicKey()}
+
+	storeKey := store.StoreAccountKey("")
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, nil, testPrivKey2.PublicKey(), "")
+
+	bundle := []asserts.Assertion{store.TrustedAccount, storeKey, acct, accKey}
+	err := asserts.ValidateBundle(bundle, trusted)
+	c.Check(err, IsNil)
+}
+
+func (chks *checkSuite) TestValidateBundleMissingAccountKey(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	trusted := []asserts.PublicKey{testPrivKey0.PublicKey()}
+
+	storeKey := store.StoreAccountKey("")
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, nil, testPrivKey2.PublicKey(), "")
+
+	bundle := []asserts.Assertion{store.TrustedAccount, acct, accKey}
+	err := asserts.ValidateBundle(bundle, trusted)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`bundle assertion account/%s: no matching public key %q for signature by "canonical"`, acct.AccountID(), storeKey.PublicKeyID()))
+}
+
+func (chks *checkSuite) TestValidateBundleMissingAccount(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+	trusted := []asserts.PublicKey{testPrivKey0.PublicKey()}
+
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	accKey := assertstest.NewAccountKey(store, acct, nil, testPrivKey2.PublicKey(), "")
+
+	bundle := []asserts.Assertion{store.TrustedAccount, store.StoreAccountKey(""), accKey}
+	err := asserts.ValidateBundle(bundle, trusted)
+	c.Check(err, ErrorMatches, fmt.Sprintf(`bundle is missing assertion account/%[1]s referenced by account-key/%[1]s/%s`, acct.AccountID(), accKey.PublicKeyID()))
+}
+
+func (chks *checkSuite) TestValidateBundleBrokenSignature(c *C) {
+	store := assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+
+	acct := assertstest.NewAccount(store, "devel1", nil, "")
+	encoded := asserts.Encode(acct)
+	tampered, err := asserts.Decode(bytes.Replace(encoded, []byte("devel1"), []byte("devel2"), -1))
+	c.Assert(err, IsNil)
+
+	bundle := []asserts.Assertion{store.TrustedAccount, store.StoreAccountKey(""), tampered}
+	err = asserts.ValidateBundle(bundle, []asserts.PublicKey{testPrivKey0.PublicKey()})
+	c.Check(err, ErrorMatches, fmt.Sprintf(`bundle assertion account/%s: failed signature verification: .*`, acct.AccountID()))
+}
+
 type signAddFindSuite struct {
 	signingDB    *asserts.Database
 	signingKeyID string
@@ -454,6 +819,547 @@ func (safs *signAddFindSuite) TestAddSuperseding(c *C) {
 	c.Check(err, ErrorMatches, "revision 0 is older than current revision 1")
 }
 
+func (safs *signAddFindSuite) TestAddPinned(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+	}
+	a1, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+
+	err = safs.db.Add(a1)
+	c.Assert(err, IsNil)
+
+	safs.db.Pin(a1.Ref())
+
+	headers["revision"] = "1"
+	a2, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+
+	err = safs.db.Add(a2)
+	c.Check(err, Equals, asserts.ErrPinned)
+
+	retrieved, err := safs.db.Find(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	})
+	c.Assert(err, IsNil)
+	c.Check(retrieved.Revision(), Equals, 0)
+
+	// other assertions are not affected
+	headers["primary-key"] = "b"
+	b2, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.Add(b2)
+	c.Check(err, IsNil)
+
+	safs.db.Unpin(asserts.Ref{Type: asserts.TestOnlyType, PrimaryKey: []string{"a"}})
+
+	err = safs.db.Add(a2)
+	c.Assert(err, IsNil)
+
+	retrieved, err = safs.db.Find(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	})
+	c.Assert(err, IsNil)
+	c.Check(retrieved.Revision(), Equals, 1)
+}
+
+func (safs *signAddFindSuite) TestAddSuperseded(c *C) {
+	type supersession struct {
+		old, new       asserts.Ref
+		oldRev, newRev int
+	}
+	var calls []supersession
+
+	cfg := &asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted: []asserts.Assertion{
+			asserts.BootstrapAccountForTest("canonical"),
+			asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey()),
+		},
+		Superseded: func(old, new asserts.Ref, oldRevision, newRevision int) {
+			calls = append(calls, supersession{old, new, oldRevision, newRevision})
+		},
+	}
+	db, err := asserts.OpenDatabase(cfg)
+	c.Assert(err, IsNil)
+
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+	}
+	a0, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = db.Add(a0)
+	c.Assert(err, IsNil)
+	// nothing superseded yet
+	c.Check(calls, HasLen, 0)
+
+	headers["revision"] = "2"
+	a2, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = db.Add(a2)
+	c.Assert(err, IsNil)
+	c.Assert(calls, HasLen, 1)
+	c.Check(calls[0], DeepEquals, supersession{a0.Ref(), a2.Ref(), 0, 2})
+
+	// failed replaces are not reported
+	headers["revision"] = "1"
+	a1, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = db.Add(a1)
+	c.Check(err, FitsTypeOf, &asserts.RevisionError{})
+
+	db.Pin(a2.Ref())
+	headers["revision"] = "3"
+	a3, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = db.Add(a3)
+	c.Check(err, Equals, asserts.ErrPinned)
+
+	c.Check(calls, HasLen, 1)
+}
+
+func (safs *signAddFindSuite) TestFindRevisioned(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+		"revision":     "2",
+	}
+	a2, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.Add(a2)
+	c.Assert(err, IsNil)
+
+	found, err := safs.db.FindRevisioned(asserts.RevisionedRef{Ref: a2.Ref(), Revision: 2})
+	c.Assert(err, IsNil)
+	c.Check(found.Revision(), Equals, 2)
+
+	found, err = safs.db.FindRevisioned(asserts.RevisionedRef{Ref: a2.Ref(), Revision: asserts.AnyRevision})
+	c.Assert(err, IsNil)
+	c.Check(found.Revision(), Equals, 2)
+}
+
+func (safs *signAddFindSuite) TestFindRevisionedNotFound(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+		"revision":     "2",
+	}
+	a2, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.Add(a2)
+	c.Assert(err, IsNil)
+
+	// only revision 2 is held
+	for _, rev := range []int{0, 1, 3} {
+		_, err = safs.db.FindRevisioned(asserts.RevisionedRef{Ref: a2.Ref(), Revision: rev})
+		c.Check(err, Equals, asserts.ErrNotFound)
+	}
+
+	ref := asserts.RevisionedRef{
+		Ref:      asserts.Ref{Type: asserts.TestOnlyType, PrimaryKey: []string{"b"}},
+		Revision: asserts.AnyRevision,
+	}
+	_, err = safs.db.FindRevisioned(ref)
+	c.Check(err, Equals, asserts.ErrNotFound)
+}
+
+func (safs *signAddFindSuite) TestVerifyAndAdd(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+	}
+	a0, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.VerifyAndAdd(a0)
+	c.Assert(err, IsNil)
+
+	headers["revision"] = "1"
+	a1, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.VerifyAndAdd(a1)
+	c.Assert(err, IsNil)
+
+	retrieved, err := safs.db.Find(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	})
+	c.Assert(err, IsNil)
+	c.Check(retrieved.Revision(), Equals, 1)
+
+	// older revisions are still rejected
+	err = safs.db.VerifyAndAdd(a0)
+	c.Check(err, FitsTypeOf, &asserts.RevisionError{})
+}
+
+func (safs *signAddFindSuite) TestAddWithProvenance(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+	}
+	a0, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+
+	_, ok := safs.db.Provenance(a0.Ref())
+	c.Check(ok, Equals, false)
+
+	fetched := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	err = safs.db.AddWithProvenance(a0, asserts.Provenance{Origin: "https://remote.example.com", Fetched: fetched})
+	c.Assert(err, IsNil)
+
+	prov, ok := safs.db.Provenance(a0.Ref())
+	c.Assert(ok, Equals, true)
+	c.Check(prov, DeepEquals, asserts.Provenance{Origin: "https://remote.example.com", Fetched: fetched})
+
+	// the stored assertion is unaffected
+	retrieved, err := safs.db.Find(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	})
+	c.Assert(err, IsNil)
+	c.Check(asserts.Encode(retrieved), DeepEquals, asserts.Encode(a0))
+	c.Check(safs.db.Check(retrieved), IsNil)
+
+	// a failed add doesn't touch the provenance
+	err = safs.db.AddWithProvenance(a0, asserts.Provenance{Origin: "other"})
+	c.Check(err, FitsTypeOf, &asserts.RevisionError{})
+	prov, ok = safs.db.Provenance(a0.Ref())
+	c.Assert(ok, Equals, true)
+	c.Check(prov.Origin, Equals, "https://remote.example.com")
+
+	// a newer revision added without provenance drops it
+	headers["revision"] = "1"
+	a1, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.Add(a1)
+	c.Assert(err, IsNil)
+	_, ok = safs.db.Provenance(a1.Ref())
+	c.Check(ok, Equals, false)
+}
+
+func (safs *signAddFindSuite) TestVerifyAndAddInvalidSignature(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+	}
+	a0, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.VerifyAndAdd(a0)
+	c.Assert(err, IsNil)
+
+	headers["revision"] = "1"
+	a1, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	// swap in the signature of a0
+	_, sig0 := a0.Signature()
+	_, sig1 := a1.Signature()
+	tampered, err := asserts.Decode(bytes.Replace(asserts.Encode(a1), sig1, sig0, 1))
+	c.Assert(err, IsNil)
+
+	err = safs.db.VerifyAndAdd(tampered)
+	c.Assert(err, ErrorMatches, "failed signature verification: .*")
+
+	// the store is left unchanged
+	retrieved, err := safs.db.Find(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	})
+	c.Assert(err, IsNil)
+	c.Check(retrieved.Revision(), Equals, 0)
+	c.Check(asserts.Encode(retrieved), DeepEquals, asserts.Encode(a0))
+}
+
+func (safs *signAddFindSuite) TestVerifyAndAddMissingPrerequisite(c *C) {
+	headers := map[string]string{
+		"authority-id": "other",
+		"primary-key":  "a",
+	}
+	err := safs.signingDB.ImportKey("other", testPrivKey1)
+	c.Assert(err, IsNil)
+	a, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, testPrivKey1.PublicKey().ID())
+	c.Assert(err, IsNil)
+
+	err = safs.db.VerifyAndAdd(a)
+	c.Assert(err, ErrorMatches, `cannot add test-only/a: missing prerequisite assertion account-key/other/.*`)
+}
+
+func (safs *signAddFindSuite) openDBWithPrimaryKeyCase(c *C, keyCase asserts.PrimaryKeyCase) *asserts.Database {
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted: []asserts.Assertion{
+			asserts.BootstrapAccountForTest("canonical"),
+			asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey()),
+		},
+		PrimaryKeyCase: keyCase,
+	})
+	c.Assert(err, IsNil)
+	err = db.ImportKey("canonical", testPrivKey0)
+	c.Assert(err, IsNil)
+	return db
+}
+
+func mixedCaseAccountHeaders() map[string]string {
+	return map[string]string{
+		"authority-id": "canonical",
+		"account-id":   "Acc-ID1",
+		"display-name": "Acct1",
+		"validation":   "unproven",
+		"timestamp":    "2016-01-01T00:00:00Z",
+	}
+}
+
+func (safs *signAddFindSuite) TestPrimaryKeyCaseIgnoredByDefault(c *C) {
+	db := safs.openDBWithPrimaryKeyCase(c, asserts.IgnorePrimaryKeyCase)
+
+	acct, err := db.Sign(asserts.AccountType, mixedCaseAccountHeaders(), nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	c.Check(acct.Header("account-id"), Equals, "Acc-ID1")
+	c.Check(db.Check(acct), IsNil)
+}
+
+func (safs *signAddFindSuite) TestPrimaryKeyCaseReject(c *C) {
+	db := safs.openDBWithPrimaryKeyCase(c, asserts.RejectMixedCasePrimaryKeys)
+
+	_, err := db.Sign(asserts.AccountType, mixedCaseAccountHeaders(), nil, safs.signingKeyID)
+	c.Check(err, ErrorMatches, `"account-id" header is not in normalized lowercase: "Acc-ID1"`)
+
+	// already signed
+	acct, err := safs.signingDB.Sign(asserts.AccountType, mixedCaseAccountHeaders(), nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = db.Check(acct)
+	c.Check(err, ErrorMatches, `"account-id" header is not in normalized lowercase: "Acc-ID1"`)
+}
+
+func (safs *signAddFindSuite) TestPrimaryKeyCaseNormalize(c *C) {
+	db := safs.openDBWithPrimaryKeyCase(c, asserts.NormalizePrimaryKeyCase)
+
+	headers := mixedCaseAccountHeaders()
+	acct, err := db.Sign(asserts.AccountType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	c.Check(acct.Header("account-id"), Equals, "acc-id1")
+	// the signature covers the normalized value
+	c.Check(db.Check(acct), IsNil)
+	// the given headers are untouched
+	c.Check(headers["account-id"], Equals, "Acc-ID1")
+
+	// already signed assertions cannot be normalized
+	signed, err := safs.signingDB.Sign(asserts.AccountType, mixedCaseAccountHeaders(), nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = db.Check(signed)
+	c.Check(err, ErrorMatches, `"account-id" header is not in normalized lowercase: "Acc-ID1"`)
+}
+
+func (safs *signAddFindSuite) TestAddOpaqueAssertion(c *C) {
+	a, err := safs.signingDB.Sign(asserts.TestOnlyType, map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+	}, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	encoded := bytes.Replace(asserts.Encode(a), []byte("type: test-only"), []byte("type: made-up"), 1)
+
+	decoder := asserts.NewDecoder(bytes.NewReader(encoded))
+	decoder.SetOpaqueUnknownTypes(true)
+	opaque, err := decoder.Decode()
+	c.Assert(err, IsNil)
+
+	err = safs.db.Add(opaque)
+	c.Check(err, ErrorMatches, `internal error: unknown assertion type: "made-up"`)
+}
+
+func (safs *signAddFindSuite) TestRefsWithRevisions(c *C) {
+	refs, err := safs.db.RefsWithRevisions()
+	c.Assert(err, IsNil)
+	// trusted assertions are not included
+	c.Check(refs, HasLen, 0)
+
+	for _, a := range []struct {
+		primaryKey, revision string
+	}{
+		{"a", "0"},
+		{"a", "2"},
+		{"b", "1"},
+	} {
+		headers := map[string]string{
+			"authority-id": "canonical",
+			"primary-key":  a.primaryKey,
+			"revision":     a.revision,
+		}
+		assert, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+		c.Assert(err, IsNil)
+		err = safs.db.Add(assert)
+		c.Assert(err, IsNil)
+	}
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"pk1":          "x",
+		"pk2":          "y",
+	}
+	a2, err := safs.signingDB.Sign(asserts.TestOnly2Type, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.Add(a2)
+	c.Assert(err, IsNil)
+
+	refs, err = safs.db.RefsWithRevisions()
+	c.Assert(err, IsNil)
+	c.Check(refs, DeepEquals, map[string]int{
+		"test-only/a":     2,
+		"test-only/b":     1,
+		"test-only-2/x/y": 0,
+	})
+
+	// a snapshot
+	headers = map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "b",
+		"revision":     "3",
+	}
+	b3, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.Add(b3)
+	c.Assert(err, IsNil)
+	c.Check(refs["test-only/b"], Equals, 1)
+}
+
+func (safs *signAddFindSuite) TestSaveToLoadFrom(c *C) {
+	for _, pk := range []string{"b", "a", "c"} {
+		headers := map[string]string{
+			"authority-id": "canonical",
+			"primary-key":  pk,
+		}
+		a, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+		c.Assert(err, IsNil)
+		err = safs.db.Add(a)
+		c.Assert(err, IsNil)
+	}
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+		"revision":     "1",
+	}
+	a1, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, nil, safs.signingKeyID)
+	c.Assert(err, IsNil)
+	err = safs.db.Add(a1)
+	c.Assert(err, IsNil)
+
+	saved := new(bytes.Buffer)
+	err = safs.db.SaveTo(saved)
+	c.Assert(err, IsNil)
+
+	// deterministic order
+	dec := asserts.NewDecoder(bytes.NewReader(saved.Bytes()))
+	var pks []string
+	for {
+		a, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		pks = append(pks, a.Header("primary-key"))
+	}
+	c.Check(pks, DeepEquals, []string{"a", "b", "c"})
+
+	// multiple primary key values are compared one by one, as by
+	// CompareRefs, not as joined strings: "acme" < "acme-x" even if
+	// "acme-x/m" < "acme/m"
+	for _, pk1 := range []string{"acme-x", "acme"} {
+		a, err := safs.signingDB.Sign(asserts.TestOnly2Type, map[string]string{
+			"authority-id": "canonical",
+			"pk1":          pk1,
+			"pk2":          "m",
+		}, nil, safs.signingKeyID)
+		c.Assert(err, IsNil)
+		err = safs.db.Add(a)
+		c.Assert(err, IsNil)
+	}
+	saved.Reset()
+	err = safs.db.SaveTo(saved)
+	c.Assert(err, IsNil)
+
+	dec = asserts.NewDecoder(bytes.NewReader(saved.Bytes()))
+	var refs []asserts.Ref
+	for {
+		a, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		refs = append(refs, a.Ref())
+	}
+	c.Assert(refs, HasLen, 5)
+	for i := 1; i < len(refs); i++ {
+		c.Check(asserts.CompareRefs(refs[i-1], refs[i]), Equals, -1)
+	}
+	c.Check(refs[3].PrimaryKey, DeepEquals, []string{"acme", "m"})
+	c.Check(refs[4].PrimaryKey, DeepEquals, []string{"acme-x", "m"})
+
+	cfg := &asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted: []asserts.Assertion{
+			asserts.BootstrapAccountForTest("canonical"),
+			asserts.BootstrapAccountKeyForTest("canonical", testPrivKey0.PublicKey()),
+		},
+	}
+	db, err := asserts.OpenDatabase(cfg)
+	c.Assert(err, IsNil)
+
+	err = db.LoadFrom(bytes.NewReader(saved.Bytes()))
+	c.Assert(err, IsNil)
+
+	for _, pk := range pks {
+		expected, err := safs.db.Find(asserts.TestOnlyType, map[string]string{
+			"primary-key": pk,
+		})
+		c.Assert(err, IsNil)
+		loaded, err := db.Find(asserts.TestOnlyType, map[string]string{
+			"primary-key": pk,
+		})
+		c.Assert(err, IsNil)
+		c.Check(asserts.Encode(loaded), DeepEquals, asserts.Encode(expected))
+	}
+
+	resaved := new(bytes.Buffer)
+	err = db.SaveTo(resaved)
+	c.Assert(err, IsNil)
+	c.Check(resaved.Bytes(), DeepEquals, saved.Bytes())
+
+	// loading again is harmless
+	err = db.LoadFrom(bytes.NewReader(saved.Bytes()))
+	c.Check(err, IsNil)
+}
+
+func (safs *signAddFindSuite) TestAddBorrowedThenReleased(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"primary-key":  "a",
+	}
+	a, err := safs.signingDB.Sign(asserts.TestOnlyType, headers, []byte("THE-BODY"), safs.signingKeyID)
+	c.Assert(err, IsNil)
+	encoded := asserts.Encode(a)
+
+	pool := &sync.Pool{New: func() interface{} {
+		return new(bytes.Buffer)
+	}}
+	decoder := asserts.NewDecoder(bytes.NewReader(encoded))
+	decoder.SetBufferPool(pool)
+	borrowed, err := decoder.Decode()
+	c.Assert(err, IsNil)
+
+	err = safs.db.Add(borrowed)
+	c.Assert(err, IsNil)
+	asserts.ReleaseAssertion(borrowed)
+	c.Check(borrowed.Body(), IsNil)
+
+	// the database kept its own copy
+	stored, err := safs.db.Find(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	})
+	c.Assert(err, IsNil)
+	c.Check(stored.Body(), DeepEquals, []byte("THE-BODY"))
+	c.Check(asserts.Encode(stored), DeepEquals, encoded)
+	c.Check(safs.db.Check(stored), IsNil)
+}
+
 func (safs *signAddFindSuite) TestFindNotFound(c *C) {
 	headers := map[string]string{
 		"authority-id": "canonical",
@@ -21,6 +21,7 @@ package asserts
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -29,10 +30,18 @@ import (
 type Model struct {
 	assertionBase
 	allowedModes  []string
-	requiredSnaps []string
+	requiredSnaps []*RequiredSnap
 	timestamp     time.Time
 }
 
+// RequiredSnap is an entry of the required snaps of a model: a snap
+// name optionally pinned to a channel, as in "pi-kernel=18/stable".
+type RequiredSnap struct {
+	Name string
+	// Channel is the pinned channel, empty if none
+	Channel string
+}
+
 // BrandID returns the brand identifier. Same as the authority id.
 func (mod *Model) BrandID() string {
 	return mod.Header("brand-id")
@@ -78,8 +87,21 @@ func (mod *Model) AllowedModes() []string {
 	return mod.allowedModes
 }
 
-// RequiredSnaps returns the snaps that must be installed at all times and cannot be removed for this model.
+// RequiredSnaps returns the names of the snaps that must be installed at all times and cannot be removed for this model.
 func (mod *Model) RequiredSnaps() []string {
+	if mod.requiredSnaps == nil {
+		return nil
+	}
+	names := make([]string, len(mod.requiredSnaps))
+	for i, req := range mod.requiredSnaps {
+		names[i] = req.Name
+	}
+	return names
+}
+
+// RequiredSnapEntries returns the snaps that must be installed at all
+// times for this model together with their optional channel pins.
+func (mod *Model) RequiredSnapEntries() []*RequiredSnap {
 	return mod.requiredSnaps
 }
 
@@ -103,6 +125,33 @@ func (mod *Model) checkConsistency(db RODatabase, acck *AccountKey) error {
 // sanity
 var _ consistencyChecker = (*Model)(nil)
 
+func checkRequiredSnaps(headers map[string]string, name string) ([]*RequiredSnap, error) {
+	entries, err := checkCommaSepList(headers, name)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		return nil, nil
+	}
+	requiredSnaps := make([]*RequiredSnap, len(entries))
+	for i, entry := range entries {
+		snapName := entry
+		channel := ""
+		if eq := strings.IndexRune(entry, '='); eq != -1 {
+			snapName = entry[:eq]
+			channel = entry[eq+1:]
+			if err := validateChannel(channel); err != nil {
+				return nil, fmt.Errorf("%q header entry %q: %v", name, entry, err)
+			}
+		}
+		if snapName == "" {
+			return nil, fmt.Errorf("missing snap name in %q header entry: %q", name, entry)
+		}
+		requiredSnaps[i] = &RequiredSnap{Name: snapName, Channel: channel}
+	}
+	return requiredSnaps, nil
+}
+
 var modelMandatory = []string{"core", "architecture", "gadget", "kernel", "store", "class"}
 
 func assembleModel(assert assertionBase) (Assertion, error) {
@@ -123,7 +172,7 @@ func assembleModel(assert assertionBase) (Assertion, error) {
 		return nil, err
 	}
 
-	requiredSnaps, err := checkCommaSepList(assert.headers, "required-snaps")
+	requiredSnaps, err := checkRequiredSnaps(assert.headers, "required-snaps")
 	if err != nil {
 		return nil, err
 	}
@@ -202,3 +251,83 @@ func assembleSerial(assert assertionBase) (Assertion, error) {
 		pubKey:        pubKey,
 	}, nil
 }
+
+// CheckSerialMatchesModel checks that serial, which must be a serial
+// assertion, is for the device model described by model, which must
+// be a model assertion, i.e. that they have the same brand-id and
+// model.
+func CheckSerialMatchesModel(serial, model Assertion) error {
+	ser, ok := serial.(*Serial)
+	if !ok {
+		return fmt.Errorf("expected a serial assertion, got %s", serial.Type().Name)
+	}
+	mod, ok := model.(*Model)
+	if !ok {
+		return fmt.Errorf("expected a model assertion, got %s", model.Type().Name)
+	}
+	if ser.BrandID() != mod.BrandID() {
+		return fmt.Errorf("serial assertion brand-id %q does not match model assertion brand-id %q", ser.BrandID(), mod.BrandID())
+	}
+	if ser.Model() != mod.Model() {
+		return fmt.Errorf("serial assertion model %q does not match model assertion model %q", ser.Model(), mod.Model())
+	}
+	return nil
+}
+
+// DeviceSessionRequest holds a device-session-request assertion,
+// which is a request by a device, signed with its device key, to
+// establish a session with the store, answering the challenge nonce
+// received from the store.
+type DeviceSessionRequest struct {
+	assertionBase
+	timestamp time.Time
+}
+
+// BrandID returns the brand identifier of the device. Same as the
+// authority id.
+func (req *DeviceSessionRequest) BrandID() string {
+	return req.Header("brand-id")
+}
+
+// Model returns the model name identifier of the device.
+func (req *DeviceSessionRequest) Model() string {
+	return req.Header("model")
+}
+
+// Serial returns the serial identifier of the device.
+func (req *DeviceSessionRequest) Serial() string {
+	return req.Header("serial")
+}
+
+// Nonce returns the challenge nonce obtained from the store.
+func (req *DeviceSessionRequest) Nonce() string {
+	return req.Header("nonce")
+}
+
+// Timestamp returns the time when the device-session-request was
+// created.
+func (req *DeviceSessionRequest) Timestamp() time.Time {
+	return req.timestamp
+}
+
+func assembleDeviceSessionRequest(assert assertionBase) (Assertion, error) {
+	if assert.headers["brand-id"] != assert.headers["authority-id"] {
+		return nil, fmt.Errorf("authority-id and brand-id must match, device-session-request assertions are expected to be signed on behalf of the brand: %q != %q", assert.headers["authority-id"], assert.headers["brand-id"])
+	}
+
+	_, err := checkNotEmpty(assert.headers, "nonce")
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := checkRFC3339Date(assert.headers, "timestamp")
+	if err != nil {
+		return nil, err
+	}
+
+	// ignore extra headers and non-empty body for future compatibility
+	return &DeviceSessionRequest{
+		assertionBase: assert,
+		timestamp:     timestamp,
+	}, nil
+}
@@ -36,6 +36,7 @@ type modelSuite struct {
 var (
 	_ = Suite(&modelSuite{})
 	_ = Suite(&serialSuite{})
+	_ = Suite(&deviceSessionRequestSuite{})
 )
 
 func (mods *modelSuite) SetUpSuite(c *C) {
@@ -82,6 +83,21 @@ func (mods *modelSuite) TestDecodeOK(c *C) {
 	c.Check(model.RequiredSnaps(), DeepEquals, []string{"foo", "bar"})
 }
 
+func (mods *modelSuite) TestDecodeRequiredSnapsWithChannels(c *C) {
+	encoded := strings.Replace(modelExample, "TSLINE", mods.tsLine, 1)
+	encoded = strings.Replace(encoded, "required-snaps: foo, bar\n", "required-snaps: foo, pi-kernel=18/stable, bar=edge, baz=latest/beta/fix-123\n", 1)
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	model := a.(*asserts.Model)
+	c.Check(model.RequiredSnaps(), DeepEquals, []string{"foo", "pi-kernel", "bar", "baz"})
+	c.Check(model.RequiredSnapEntries(), DeepEquals, []*asserts.RequiredSnap{
+		{Name: "foo"},
+		{Name: "pi-kernel", Channel: "18/stable"},
+		{Name: "bar", Channel: "edge"},
+		{Name: "baz", Channel: "latest/beta/fix-123"},
+	})
+}
+
 const (
 	modelErrPrefix = "assertion model: "
 )
@@ -112,6 +128,10 @@ func (mods *modelSuite) TestDecodeInvalid(c *C) {
 		{"allowed-modes: \n", "allowed-modes: ,\n", `empty entry in comma separated "allowed-modes" header: ","`},
 		{"required-snaps: foo, bar\n", "", `"required-snaps" header is mandatory`},
 		{"required-snaps: foo, bar\n", "required-snaps: foo,\n", `empty entry in comma separated "required-snaps" header: "foo,"`},
+		{"required-snaps: foo, bar\n", "required-snaps: foo=18/stablish\n", `"required-snaps" header entry "foo=18/stablish": invalid channel: "18/stablish"`},
+		{"required-snaps: foo, bar\n", "required-snaps: foo=\n", `"required-snaps" header entry "foo=": invalid channel: ""`},
+		{"required-snaps: foo, bar\n", "required-snaps: foo=18//stable\n", `"required-snaps" header entry "foo=18//stable": invalid channel: "18//stable"`},
+		{"required-snaps: foo, bar\n", "required-snaps: =stable\n", `missing snap name in "required-snaps" header entry: "=stable"`},
 		{"class: fixed\n", "", `"class" header is mandatory`},
 		{"class: fixed\n", "class: \n", `"class" header should not be empty`},
 		{mods.tsLine, "", `"timestamp" header is mandatory`},
@@ -234,3 +254,91 @@ func (ss *serialSuite) TestDecodeInvalid(c *C) {
 		c.Check(err, ErrorMatches, serialErrPrefix+test.expectedErr)
 	}
 }
+
+func (ss *serialSuite) TestCheckSerialMatchesModel(c *C) {
+	encodedSerial := strings.Replace(serialExample, "TSLINE", ss.tsLine, 1)
+	encodedSerial = strings.Replace(encodedSerial, "DEVICEKEY", strings.Replace(ss.encodedDevKey, "\n", "\n ", -1), 1)
+	serial, err := asserts.Decode([]byte(encodedSerial))
+	c.Assert(err, IsNil)
+
+	encodedModel := strings.Replace(modelExample, "TSLINE", ss.tsLine, 1)
+	model, err := asserts.Decode([]byte(encodedModel))
+	c.Assert(err, IsNil)
+
+	c.Check(asserts.CheckSerialMatchesModel(serial, model), IsNil)
+
+	tests := []struct{ original, mismatched, expectedErr string }{
+		{"brand-id1\n", "brand-id2\n", `serial assertion brand-id "brand-id1" does not match model assertion brand-id "brand-id2"`},
+		{"model: baz-3000\n", "model: baz-4000\n", `serial assertion model "baz-3000" does not match model assertion model "baz-4000"`},
+	}
+	for _, test := range tests {
+		// for the brand this changes both authority-id and brand-id
+		mismatched := strings.Replace(encodedModel, test.original, test.mismatched, -1)
+		model, err := asserts.Decode([]byte(mismatched))
+		c.Assert(err, IsNil)
+		c.Check(asserts.CheckSerialMatchesModel(serial, model), ErrorMatches, test.expectedErr)
+	}
+
+	// wrong types
+	c.Check(asserts.CheckSerialMatchesModel(model, model), ErrorMatches, "expected a serial assertion, got model")
+	c.Check(asserts.CheckSerialMatchesModel(serial, serial), ErrorMatches, "expected a model assertion, got serial")
+}
+
+type deviceSessionRequestSuite struct {
+	ts     time.Time
+	tsLine string
+}
+
+func (dsrs *deviceSessionRequestSuite) SetUpSuite(c *C) {
+	dsrs.ts = time.Now().Truncate(time.Second).UTC()
+	dsrs.tsLine = "timestamp: " + dsrs.ts.Format(time.RFC3339) + "\n"
+}
+
+const deviceSessionRequestExample = "type: device-session-request\n" +
+	"authority-id: brand-id1\n" +
+	"brand-id: brand-id1\n" +
+	"model: baz-3000\n" +
+	"serial: 2700\n" +
+	"nonce: @@@@@@\n" +
+	"TSLINE" +
+	"body-length: 0" +
+	"\n\n" +
+	"openpgp c2ln"
+
+func (dsrs *deviceSessionRequestSuite) TestDecodeOK(c *C) {
+	encoded := strings.Replace(deviceSessionRequestExample, "TSLINE", dsrs.tsLine, 1)
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.DeviceSessionRequestType)
+	req := a.(*asserts.DeviceSessionRequest)
+	c.Check(req.AuthorityID(), Equals, "brand-id1")
+	c.Check(req.BrandID(), Equals, "brand-id1")
+	c.Check(req.Model(), Equals, "baz-3000")
+	c.Check(req.Serial(), Equals, "2700")
+	c.Check(req.Nonce(), Equals, "@@@@@@")
+	c.Check(req.Timestamp(), Equals, dsrs.ts)
+}
+
+const (
+	deviceSessionRequestErrPrefix = "assertion device-session-request: "
+)
+
+func (dsrs *deviceSessionRequestSuite) TestDecodeInvalid(c *C) {
+	encoded := strings.Replace(deviceSessionRequestExample, "TSLINE", dsrs.tsLine, 1)
+
+	invalidTests := []struct{ original, invalid, expectedErr string }{
+		{"brand-id: brand-id1\n", "brand-id: other\n", `authority-id and brand-id must match, device-session-request assertions are expected to be signed on behalf of the brand: "brand-id1" != "other"`},
+		{"model: baz-3000\n", "", `"model" header is mandatory`},
+		{"serial: 2700\n", "serial: \n", `"serial" header should not be empty`},
+		{"nonce: @@@@@@\n", "", `"nonce" header is mandatory`},
+		{"nonce: @@@@@@\n", "nonce: \n", `"nonce" header should not be empty`},
+		{dsrs.tsLine, "", `"timestamp" header is mandatory`},
+		{dsrs.tsLine, "timestamp: 12:30\n", `"timestamp" header is not a RFC3339 date: .*`},
+	}
+
+	for _, test := range invalidTests {
+		invalid := strings.Replace(encoded, test.original, test.invalid, 1)
+		_, err := asserts.Decode([]byte(invalid))
+		c.Check(err, ErrorMatches, deviceSessionRequestErrPrefix+test.expectedErr)
+	}
+}
@@ -20,9 +20,13 @@
 package asserts
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"sort"
 )
 
 // EncodeDigest encodes a hash algorithm and a digest to be put in an assertion header.
@@ -39,3 +43,60 @@ func EncodeDigest(hash crypto.Hash, hashDigest []byte) (string, error) {
 	}
 	return fmt.Sprintf("%s-%s", algo, base64.RawURLEncoding.EncodeToString(hashDigest)), nil
 }
+
+type bundleEntry struct {
+	ref      Ref
+	revision int
+	encoded  []byte
+}
+
+type byCanonicalKey []bundleEntry
+
+func (b byCanonicalKey) Len() int      { return len(b) }
+func (b byCanonicalKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCanonicalKey) Less(i, j int) bool {
+	if cmp := CompareRefs(b[i].ref, b[j].ref); cmp != 0 {
+		return cmp < 0
+	}
+	if b[i].revision != b[j].revision {
+		return b[i].revision < b[j].revision
+	}
+	return string(b[i].encoded) < string(b[j].encoded)
+}
+
+// BundleDigest decodes the stream of assertions from r and returns a
+// digest of them that does not depend on their order in the stream.
+func BundleDigest(r io.Reader) (string, error) {
+	d := NewDecoder(r)
+	var entries []bundleEntry
+	for {
+		a, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		// the signature of an assertion in a stream can end in a
+		// newline depending on the separator that follows it
+		content, signature := a.Signature()
+		encoded := make([]byte, 0, len(content)+len(nlnl)+len(signature))
+		encoded = append(encoded, content...)
+		encoded = append(encoded, nlnl...)
+		encoded = append(encoded, bytes.TrimRight(signature, "\n")...)
+		entries = append(entries, bundleEntry{
+			ref:      a.Ref(),
+			revision: a.Revision(),
+			encoded:  encoded,
+		})
+	}
+	sort.Sort(byCanonicalKey(entries))
+
+	h := sha512.New()
+	for _, entry := range entries {
+		// length prefix each assertion to avoid ambiguities
+		fmt.Fprintf(h, "%d\n", len(entry.encoded))
+		h.Write(entry.encoded)
+	}
+	return EncodeDigest(crypto.SHA512, h.Sum(nil))
+}
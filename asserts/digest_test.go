@@ -54,3 +54,49 @@ func (eds *encodeDigestSuite) TestEncodeDigestErrors(c *C) {
 	_, err = asserts.EncodeDigest(crypto.SHA512, []byte{1, 2})
 	c.Check(err, ErrorMatches, "hash digest by sha512 should be 64 bytes")
 }
+
+func (eds *encodeDigestSuite) TestBundleDigest(c *C) {
+	a1 := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: a" +
+		"\n\n" +
+		"openpgp c2ln"
+	a2 := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: b" +
+		"\n\n" +
+		"openpgp c2ln"
+	a3 := "type: test-only-2\n" +
+		"authority-id: auth-id1\n" +
+		"pk1: a\n" +
+		"pk2: b" +
+		"\n\n" +
+		"openpgp c2ln"
+
+	digest, err := asserts.BundleDigest(strings.NewReader(strings.Join([]string{a1, a2, a3}, "\n\n")))
+	c.Assert(err, IsNil)
+	c.Check(strings.HasPrefix(digest, "sha512-"), Equals, true)
+
+	// the order does not matter
+	for _, order := range [][]string{{a3, a2, a1}, {a2, a3, a1}} {
+		other, err := asserts.BundleDigest(strings.NewReader(strings.Join(order, "\n\n")))
+		c.Assert(err, IsNil)
+		c.Check(other, Equals, digest)
+	}
+
+	// a changed assertion changes the digest
+	changed := strings.Replace(a2, "openpgp c2ln", "openpgp c2lo", 1)
+	other, err := asserts.BundleDigest(strings.NewReader(strings.Join([]string{a1, changed, a3}, "\n\n")))
+	c.Assert(err, IsNil)
+	c.Check(other, Not(Equals), digest)
+
+	// as does a missing one
+	other, err = asserts.BundleDigest(strings.NewReader(strings.Join([]string{a1, a3}, "\n\n")))
+	c.Assert(err, IsNil)
+	c.Check(other, Not(Equals), digest)
+}
+
+func (eds *encodeDigestSuite) TestBundleDigestError(c *C) {
+	_, err := asserts.BundleDigest(strings.NewReader("type: test-only\n"))
+	c.Check(err, NotNil)
+}
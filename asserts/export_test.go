@@ -21,6 +21,7 @@ package asserts
 
 import (
 	"io"
+	"sort"
 	"time"
 
 	"golang.org/x/crypto/openpgp/packet"
@@ -47,9 +48,31 @@ func NewDecoderStressed(r io.Reader, bufSize, maxHeadersSize, maxBodySize, maxSi
 		maxHeadersSize: maxHeadersSize,
 		maxBodySize:    maxBodySize,
 		maxSigSize:     maxSigSize,
+
+		maxHeaderValueSize: MaxHeaderValueSize,
 	}).initBuffer()
 }
 
+// DecoderRebuffers returns how many times the Decoder replaced its buffer.
+func DecoderRebuffers(d *Decoder) int {
+	return d.rebuffers
+}
+
+// DecoderBufferSize returns the current size of the Decoder buffer.
+func DecoderBufferSize(d *Decoder) int {
+	return d.bufSize
+}
+
+// VerifyWithPublicKey verifies the signature of assert using pubKey, for tests
+func VerifyWithPublicKey(assert Assertion, pubKey PublicKey) error {
+	content, signature := assert.Signature()
+	sig, err := decodeSignature(signature)
+	if err != nil {
+		return err
+	}
+	return pubKey.verify(content, sig)
+}
+
 // Encoder.append exposed for tests
 func EncoderAppend(enc *Encoder, encoded []byte) error {
 	return enc.append(encoded)
@@ -107,7 +130,11 @@ func assembleTestOnly(assert assertionBase) (Assertion, error) {
 	return &TestOnly{assert}, nil
 }
 
-var TestOnlyType = &AssertionType{"test-only", []string{"primary-key"}, assembleTestOnly}
+var TestOnlyType = &AssertionType{
+	Name:       "test-only",
+	PrimaryKey: []string{"primary-key"},
+	assembler:  assembleTestOnly,
+}
 
 type TestOnly2 struct {
 	assertionBase
@@ -117,11 +144,81 @@ func assembleTestOnly2(assert assertionBase) (Assertion, error) {
 	return &TestOnly2{assert}, nil
 }
 
-var TestOnly2Type = &AssertionType{"test-only-2", []string{"pk1", "pk2"}, assembleTestOnly2}
+// TestOnly2Type has a small type specific maximum body size
+var TestOnly2Type = &AssertionType{
+	Name:        "test-only-2",
+	PrimaryKey:  []string{"pk1", "pk2"},
+	MaxBodySize: 16,
+	assembler:   assembleTestOnly2,
+}
+
+// TestOnlyOrderedType hints an order for some of its headers
+var TestOnlyOrderedType = &AssertionType{
+	Name:        "test-only-ordered",
+	PrimaryKey:  []string{"primary-key"},
+	assembler:   assembleTestOnly,
+	headerOrder: []string{"zeta", "alpha", "primary-key"},
+}
 
 func init() {
 	typeRegistry[TestOnlyType.Name] = TestOnlyType
 	typeRegistry[TestOnly2Type.Name] = TestOnly2Type
+	typeRegistry[TestOnlyOrderedType.Name] = TestOnlyOrderedType
+}
+
+// RegisteredTypes returns all the registered assertion types sorted
+// by name, for tests
+func RegisteredTypes() []*AssertionType {
+	names := make([]string, 0, len(typeRegistry))
+	for name := range typeRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	types := make([]*AssertionType, len(names))
+	for i, name := range names {
+		types[i] = typeRegistry[name]
+	}
+	return types
+}
+
+// SelfCheck exposes the consistency check of an assertion parsed
+// headers, revision and body against its content
+func SelfCheck(a Assertion) error {
+	return a.(interface {
+		selfCheck() error
+	}).selfCheck()
+}
+
+// TamperInTest changes the held parsed state of an assertion behind
+// its content, an empty name tampers with the body
+func (ab *assertionBase) TamperInTest(name, value string) {
+	switch name {
+	case "":
+		ab.body = []byte(value)
+	case "revision":
+		ab.revision++
+	default:
+		ab.headers[name] = value
+	}
+}
+
+// header value validators exposed for tests
+var (
+	ValidateSeries  = validateSeries
+	ValidateChannel = validateChannel
+)
+
+// CheckRegistryInTest runs the registry checks on the given registry
+var CheckRegistryInTest = checkRegistry
+
+// AssertionTypeInTest builds an AssertionType for registry tests,
+// with an assembler if withAssembler is true
+func AssertionTypeInTest(name string, primaryKey []string, withAssembler bool) *AssertionType {
+	t := &AssertionType{Name: name, PrimaryKey: primaryKey}
+	if withAssembler {
+		t.assembler = assembleTestOnly
+	}
+	return t
 }
 
 // AccountKeyIsKeyValidAt exposes isKeyValidAt on AccountKey for tests
@@ -0,0 +1,105 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts
+
+import (
+	"fmt"
+)
+
+const defaultMaxFetches = 100
+
+// Fetcher fetches from a remote source the prerequisites needed to
+// verify assertions, adding them to a local database.
+type Fetcher struct {
+	db         *Database
+	retrieve   func(Ref) (Assertion, error)
+	maxFetches int
+	fetches    int
+}
+
+// NewFetcher returns a Fetcher adding to db the prerequisites it
+// obtains using retrieve.
+func NewFetcher(db *Database, retrieve func(Ref) (Assertion, error)) *Fetcher {
+	return &Fetcher{
+		db:         db,
+		retrieve:   retrieve,
+		maxFetches: defaultMaxFetches,
+	}
+}
+
+// SetMaxFetches sets the maximum number of assertions the Fetcher
+// will retrieve overall.
+func (f *Fetcher) SetMaxFetches(max int) {
+	f.maxFetches = max
+}
+
+// Fetch retrieves and adds to the database, recursively, the missing
+// prerequisites of the leaf assertion until it can be verified. The
+// leaf itself is not added.
+func (f *Fetcher) Fetch(leaf Assertion) error {
+	return f.fetchPrerequisites(leaf, make(map[string]bool))
+}
+
+func (f *Fetcher) fetchPrerequisites(a Assertion, inProgress map[string]bool) error {
+	refs, err := Prerequisites(a, f.db)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		u := ref.Unique()
+		if inProgress[u] {
+			return fmt.Errorf("cannot fetch %q assertion %v: circular prerequisites", ref.Type.Name, ref.PrimaryKey)
+		}
+		// could have been fetched meanwhile as prerequisite of a
+		// previous ref
+		_, err := ref.find(f.db)
+		if err == nil {
+			continue
+		}
+		if err != ErrNotFound {
+			return err
+		}
+		if f.fetches >= f.maxFetches {
+			return fmt.Errorf("cannot fetch %q assertion %v: maximum number of fetches (%d) exceeded", ref.Type.Name, ref.PrimaryKey, f.maxFetches)
+		}
+		f.fetches++
+		prereq, err := f.retrieve(ref)
+		if err != nil {
+			return fmt.Errorf("cannot fetch %q assertion %v: %v", ref.Type.Name, ref.PrimaryKey, err)
+		}
+		if prereq == nil {
+			return fmt.Errorf("cannot fetch %q assertion %v: no assertion returned", ref.Type.Name, ref.PrimaryKey)
+		}
+		if prereq.Ref().Unique() != u {
+			return fmt.Errorf("cannot fetch %q assertion %v: got a different assertion", ref.Type.Name, ref.PrimaryKey)
+		}
+		inProgress[u] = true
+		err = f.fetchPrerequisites(prereq, inProgress)
+		delete(inProgress, u)
+		if err != nil {
+			return err
+		}
+		err = f.db.Add(prereq)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
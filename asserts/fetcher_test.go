@@ -0,0 +1,162 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts_test
+
+import (
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+)
+
+type fetcherSuite struct {
+	store *assertstest.StoreStack
+	db    *asserts.Database
+}
+
+var _ = Suite(&fetcherSuite{})
+
+func (s *fetcherSuite) SetUpTest(c *C) {
+	s.store = assertstest.NewStoreStack("canonical", testPrivKey0, testPrivKey1)
+
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        s.store.Trusted,
+	})
+	c.Assert(err, IsNil)
+	s.db = db
+}
+
+func refHeaders(ref asserts.Ref) map[string]string {
+	headers := make(map[string]string)
+	for i, name := range ref.Type.PrimaryKey {
+		headers[name] = ref.PrimaryKey[i]
+	}
+	return headers
+}
+
+func (s *fetcherSuite) TestFetchChain(c *C) {
+	prereqDevAccount(c, s.store, s.store.Database)
+	prereqSnapDecl(c, s.store, s.store.Database)
+
+	snapRev, err := s.store.Sign(asserts.SnapRevisionType, map[string]string{
+		"series":        "16",
+		"snap-id":       "snap-id-1",
+		"snap-digest":   "sha256 ...",
+		"snap-size":     "123",
+		"snap-revision": "1",
+		"developer-id":  "dev-id1",
+		"timestamp":     time.Now().Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	var fetched []string
+	retrieve := func(ref asserts.Ref) (asserts.Assertion, error) {
+		fetched = append(fetched, ref.Type.Name)
+		return s.store.Find(ref.Type, refHeaders(ref))
+	}
+
+	f := asserts.NewFetcher(s.db, retrieve)
+	err = f.Fetch(snapRev)
+	c.Assert(err, IsNil)
+
+	c.Check(fetched, DeepEquals, []string{"account-key", "account", "snap-declaration"})
+	c.Check(s.db.Check(snapRev), IsNil)
+}
+
+func (s *fetcherSuite) TestFetchMaxFetches(c *C) {
+	prereqDevAccount(c, s.store, s.store.Database)
+	prereqSnapDecl(c, s.store, s.store.Database)
+
+	snapDecl, err := s.store.Find(asserts.SnapDeclarationType, map[string]string{
+		"series":  "16",
+		"snap-id": "snap-id-1",
+	})
+	c.Assert(err, IsNil)
+
+	retrieve := func(ref asserts.Ref) (asserts.Assertion, error) {
+		return s.store.Find(ref.Type, refHeaders(ref))
+	}
+
+	f := asserts.NewFetcher(s.db, retrieve)
+	f.SetMaxFetches(1)
+	err = f.Fetch(snapDecl)
+	c.Check(err, ErrorMatches, `cannot fetch "account" assertion \[dev-id1\]: maximum number of fetches \(1\) exceeded`)
+}
+
+func (s *fetcherSuite) TestFetchRetrieveError(c *C) {
+	acct := assertstest.NewAccount(s.store, "devel1", nil, "")
+
+	retrieve := func(ref asserts.Ref) (asserts.Assertion, error) {
+		return nil, fmt.Errorf("boom")
+	}
+
+	f := asserts.NewFetcher(s.db, retrieve)
+	err := f.Fetch(acct)
+	c.Check(err, ErrorMatches, `cannot fetch "account-key" assertion \[canonical [a-f0-9]+\]: boom`)
+}
+
+func (s *fetcherSuite) TestFetchRetrieveNothing(c *C) {
+	acct := assertstest.NewAccount(s.store, "devel1", nil, "")
+
+	retrieve := func(ref asserts.Ref) (asserts.Assertion, error) {
+		return nil, nil
+	}
+
+	f := asserts.NewFetcher(s.db, retrieve)
+	err := f.Fetch(acct)
+	c.Check(err, ErrorMatches, `cannot fetch "account-key" assertion \[canonical [a-f0-9]+\]: no assertion returned`)
+}
+
+func (s *fetcherSuite) TestFetchCycle(c *C) {
+	acct := assertstest.NewAccount(s.store, "devel1", nil, "")
+	devDB1 := assertstest.NewSigningDB(acct.AccountID(), testPrivKey1)
+	devDB2 := assertstest.NewSigningDB(acct.AccountID(), testPrivKey2)
+
+	// each key is signed by the other one
+	key1 := assertstest.NewAccountKey(devDB2, acct, nil, testPrivKey1.PublicKey(), "")
+	key2 := assertstest.NewAccountKey(devDB1, acct, nil, testPrivKey2.PublicKey(), "")
+
+	remote := map[string]asserts.Assertion{
+		testPrivKey1.PublicKey().ID(): key1,
+		testPrivKey2.PublicKey().ID(): key2,
+	}
+
+	leaf, err := devDB1.Sign(asserts.TestOnlyType, map[string]string{
+		"primary-key": "a",
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	fetches := 0
+	retrieve := func(ref asserts.Ref) (asserts.Assertion, error) {
+		fetches++
+		c.Assert(ref.Type, Equals, asserts.AccountKeyType)
+		return remote[ref.PrimaryKey[1]], nil
+	}
+
+	f := asserts.NewFetcher(s.db, retrieve)
+	err = f.Fetch(leaf)
+	c.Check(err, ErrorMatches, `cannot fetch "account-key" assertion \[.* [a-f0-9]+\]: circular prerequisites`)
+	c.Check(fetches, Equals, 2)
+}
@@ -21,9 +21,11 @@ package asserts
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // common checks used when decoding/assembling assertions
@@ -58,6 +60,124 @@ func checkPrimaryKey(headers map[string]string, primKey string) (string, error)
 	return value, nil
 }
 
+// formats of common headers
+var (
+	seriesFormat = regexp.MustCompile("^[0-9]+$")
+	snapIDFormat = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-]*$")
+	// account ids are used as key references and path components
+	accountIDFormat = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-]*$")
+	// channels are of the form [<track>/]<risk>[/<branch>]
+	channelFormat = regexp.MustCompile("^(?:[a-zA-Z0-9][a-zA-Z0-9._-]*/)?(?:stable|candidate|beta|edge)(?:/[a-zA-Z0-9][a-zA-Z0-9._-]*)?$")
+
+	seriesHeaderFormats = map[string]func(string) error{
+		"series": validateSeries,
+	}
+	snapHeaderFormats = map[string]func(string) error{
+		"series":  validateSeries,
+		"snap-id": validateSnapID,
+	}
+)
+
+// validateSeries checks a series value, as carried by the "series"
+// header of many types.
+func validateSeries(series string) error {
+	if !seriesFormat.MatchString(series) {
+		return fmt.Errorf("invalid series: %q", series)
+	}
+	return nil
+}
+
+// validateSnapID checks a snap-id value.
+func validateSnapID(snapID string) error {
+	if !snapIDFormat.MatchString(snapID) {
+		return fmt.Errorf("invalid snap-id: %q", snapID)
+	}
+	return nil
+}
+
+// validateChannel checks a channel value, of the form
+// [<track>/]<risk>[/<branch>].
+func validateChannel(channel string) error {
+	if !channelFormat.MatchString(channel) {
+		return fmt.Errorf("invalid channel: %q", channel)
+	}
+	return nil
+}
+
+func checkAuthorityID(headers map[string]string) (string, error) {
+	authorityID, err := checkNotEmpty(headers, "authority-id")
+	if err != nil {
+		return "", err
+	}
+	if !accountIDFormat.MatchString(authorityID) {
+		return "", fmt.Errorf(`"authority-id" header has invalid format: %q`, authorityID)
+	}
+	return authorityID, nil
+}
+
+// checkHeaderFormats checks the present headers against the formats
+// declared by the assertion type.
+func checkHeaderFormats(assertType *AssertionType, headers map[string]string) error {
+	for name, validate := range assertType.headerFormats {
+		value, ok := headers[name]
+		if !ok {
+			continue
+		}
+		if err := validate(value); err != nil {
+			return fmt.Errorf("%q header: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// PrimaryKeyCase specifies how mixed-case values are treated for the
+// primary key headers that are expected to be in normalized
+// lowercase, like account-id.
+type PrimaryKeyCase int
+
+const (
+	// IgnorePrimaryKeyCase accepts primary key values as they are.
+	IgnorePrimaryKeyCase PrimaryKeyCase = iota
+	// RejectMixedCasePrimaryKeys rejects values that are not lowercase.
+	RejectMixedCasePrimaryKeys
+	// NormalizePrimaryKeyCase lowercases values before signing. As the
+	// signature covers them, already signed assertions cannot be
+	// normalized and are rejected instead.
+	NormalizePrimaryKeyCase
+)
+
+// checkPrimaryKeyCase checks the case of the normalized primary key
+// headers according to keyCase. With NormalizePrimaryKeyCase it
+// returns a copy of headers with lowercased values, otherwise
+// headers itself.
+func checkPrimaryKeyCase(assertType *AssertionType, headers map[string]string, keyCase PrimaryKeyCase) (map[string]string, error) {
+	if keyCase == IgnorePrimaryKeyCase {
+		return headers, nil
+	}
+	var normalized map[string]string
+	for _, name := range assertType.lowercasePrimaryKey {
+		value := headers[name]
+		lower := strings.ToLower(value)
+		if value == lower {
+			continue
+		}
+		if keyCase != NormalizePrimaryKeyCase {
+			return nil, fmt.Errorf("%q header is not in normalized lowercase: %q", name, value)
+		}
+		if normalized == nil {
+			normalized = make(map[string]string, len(headers))
+			for k, v := range headers {
+				normalized[k] = v
+			}
+		}
+		normalized[name] = lower
+	}
+	if normalized != nil {
+		return normalized, nil
+	}
+	return headers, nil
+}
+
 func checkAssertType(assertType *AssertionType) error {
 	if assertType == nil {
 		return fmt.Errorf("internal error: assertion type cannot be nil")
@@ -75,15 +195,61 @@ func checkAssertType(assertType *AssertionType) error {
 	}
 }
 
+// maxReportedValueSize is how much of an invalid header value is
+// reported in errors
+const maxReportedValueSize = 64
+
+// reportedValue returns value for inclusion in an error, truncated
+// if it is too long.
+func reportedValue(value string) string {
+	if len(value) <= maxReportedValueSize {
+		return value
+	}
+	cut := maxReportedValueSize
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + "..."
+}
+
+// canonicalInteger matches the only accepted representation of
+// integers, which re-encodes the same: no sign for positive values,
+// no leading zeros and no surrounding spaces
+var canonicalInteger = regexp.MustCompile("^(0|-?[1-9][0-9]*)$")
+
 // use 'defl' default if missing
 func checkInteger(headers map[string]string, name string, defl int) (int, error) {
 	valueStr, ok := headers[name]
 	if !ok {
 		return defl, nil
 	}
+	if !canonicalInteger.MatchString(valueStr) {
+		return -1, fmt.Errorf("%q header is not an integer: %v", name, reportedValue(valueStr))
+	}
 	value, err := strconv.Atoi(valueStr)
 	if err != nil {
-		return -1, fmt.Errorf("%q header is not an integer: %v", name, valueStr)
+		return -1, fmt.Errorf("%q header is not an integer: %v", name, reportedValue(valueStr))
+	}
+	return value, nil
+}
+
+func checkBodyLength(headers map[string]string) (int, error) {
+	valueStr, ok := headers["body-length"]
+	if !ok {
+		return 0, nil
+	}
+	if !canonicalInteger.MatchString(valueStr) {
+		return -1, fmt.Errorf(`"body-length" header is not an integer: %v`, reportedValue(valueStr))
+	}
+	value, err := strconv.Atoi(valueStr)
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+		return -1, fmt.Errorf(`"body-length" header is out of range: %v`, reportedValue(valueStr))
+	}
+	if err != nil {
+		return -1, fmt.Errorf(`"body-length" header is not an integer: %v`, reportedValue(valueStr))
+	}
+	if value < 0 {
+		return -1, fmt.Errorf(`"body-length" header should not be negative: %v`, reportedValue(valueStr))
 	}
 	return value, nil
 }
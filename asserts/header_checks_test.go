@@ -0,0 +1,48 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+)
+
+type headerChecksSuite struct{}
+
+var _ = Suite(&headerChecksSuite{})
+
+func (s *headerChecksSuite) TestValidateSeries(c *C) {
+	for _, series := range []string{"16", "0", "2016"} {
+		c.Check(asserts.ValidateSeries(series), IsNil, Commentf(series))
+	}
+	for _, series := range []string{"", "x16", "16.04", " 16", "-1"} {
+		c.Check(asserts.ValidateSeries(series), ErrorMatches, `invalid series: ".*"`, Commentf(series))
+	}
+}
+
+func (s *headerChecksSuite) TestValidateChannel(c *C) {
+	for _, channel := range []string{"stable", "edge", "1.0/beta", "candidate/hotfix-1", "lts/stable/fix.2"} {
+		c.Check(asserts.ValidateChannel(channel), IsNil, Commentf(channel))
+	}
+	for _, channel := range []string{"", "foo", "1.0/", "/stable", "stable/", "1.0/stable/fix/more", "a b/stable"} {
+		c.Check(asserts.ValidateChannel(channel), ErrorMatches, `invalid channel: ".*"`, Commentf(channel))
+	}
+}
@@ -21,6 +21,8 @@ package asserts
 
 import (
 	"fmt"
+	"io"
+	"sort"
 	"time"
 )
 
@@ -83,6 +85,10 @@ func (snapdcl *SnapDeclaration) checkConsistency(db RODatabase, acck *AccountKey
 // sanity
 var _ consistencyChecker = (*SnapDeclaration)(nil)
 
+func (snapdcl *SnapDeclaration) prerequisites() []Ref {
+	return []Ref{{Type: AccountType, PrimaryKey: []string{snapdcl.PublisherID()}}}
+}
+
 func assembleSnapDeclaration(assert assertionBase) (Assertion, error) {
 	_, err := checkExists(assert.headers, "snap-name")
 	if err != nil {
@@ -254,6 +260,13 @@ func (snaprev *SnapRevision) checkConsistency(db RODatabase, acck *AccountKey) e
 // sanity
 var _ consistencyChecker = (*SnapRevision)(nil)
 
+func (snaprev *SnapRevision) prerequisites() []Ref {
+	return []Ref{
+		{Type: AccountType, PrimaryKey: []string{snaprev.DeveloperID()}},
+		{Type: SnapDeclarationType, PrimaryKey: []string{snaprev.Series(), snaprev.SnapID()}},
+	}
+}
+
 func assembleSnapRevision(assert assertionBase) (Assertion, error) {
 	// TODO: more parsing/checking of snap-digest
 
@@ -284,3 +297,34 @@ func assembleSnapRevision(assert assertionBase) (Assertion, error) {
 		timestamp:     timestamp,
 	}, nil
 }
+
+// SnapIDs returns the sorted distinct snap-ids referenced by the
+// snap-declaration, snap-build and snap-revision assertions in the
+// stream from r. Assertions of other types are ignored.
+func SnapIDs(r io.Reader) ([]string, error) {
+	d := NewDecoder(r)
+	seen := make(map[string]bool)
+	var snapIDs []string
+	for {
+		a, err := d.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		withSnapID, ok := a.(interface {
+			SnapID() string
+		})
+		if !ok {
+			continue
+		}
+		snapID := withSnapID.SnapID()
+		if !seen[snapID] {
+			seen[snapID] = true
+			snapIDs = append(snapIDs, snapID)
+		}
+	}
+	sort.Strings(snapIDs)
+	return snapIDs, nil
+}
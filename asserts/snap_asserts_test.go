@@ -20,6 +20,8 @@
 package asserts_test
 
 import (
+	"encoding/json"
+	"sort"
 	"strings"
 	"time"
 
@@ -70,6 +72,35 @@ func (sds *snapDeclSuite) TestDecodeOK(c *C) {
 	c.Check(snapDecl.Gates(), DeepEquals, []string{"snap-id-3", "snap-id-4"})
 }
 
+func (sds *snapDeclSuite) TestSummary(c *C) {
+	encoded := "type: snap-declaration\n" +
+		"authority-id: canonical\n" +
+		"revision: 3\n" +
+		"series: 16\n" +
+		"snap-id: snap-id-1\n" +
+		"snap-name: first\n" +
+		"publisher-id: dev-id1\n" +
+		"gates: \n" +
+		sds.tsLine +
+		"body-length: 0" +
+		"\n\n" +
+		"openpgp c2ln"
+	a, err := asserts.Decode([]byte(encoded))
+	c.Assert(err, IsNil)
+
+	summary := asserts.Summary(a)
+	c.Check(summary, DeepEquals, asserts.AssertionSummary{
+		Type:        "snap-declaration",
+		PrimaryKey:  []string{"16", "snap-id-1"},
+		Revision:    3,
+		AuthorityID: "canonical",
+	})
+
+	b, err := json.Marshal(summary)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, `{"type":"snap-declaration","primary-key":["16","snap-id-1"],"revision":3,"authority-id":"canonical"}`)
+}
+
 func (sds *snapDeclSuite) TestEmptySnapName(c *C) {
 	encoded := "type: snap-declaration\n" +
 		"authority-id: canonical\n" +
@@ -110,6 +141,9 @@ func (sds *snapDeclSuite) TestDecodeInvalid(c *C) {
 		{"series: 16\n", "series: \n", `"series" header should not be empty`},
 		{"snap-id: snap-id-1\n", "", `"snap-id" header is mandatory`},
 		{"snap-id: snap-id-1\n", "snap-id: \n", `"snap-id" header should not be empty`},
+		{"snap-id: snap-id-1\n", "snap-id: snap_id\n", `"snap-id" header: invalid snap-id: "snap_id"`},
+		{"snap-id: snap-id-1\n", "snap-id: -snapid\n", `"snap-id" header: invalid snap-id: "-snapid"`},
+		{"series: 16\n", "series: sixteen\n", `"series" header: invalid series: "sixteen"`},
 		{"snap-name: first\n", "", `"snap-name" header is mandatory`},
 		{"publisher-id: dev-id1\n", "", `"publisher-id" header is mandatory`},
 		{"publisher-id: dev-id1\n", "publisher-id: \n", `"publisher-id" header should not be empty`},
@@ -128,6 +162,20 @@ func (sds *snapDeclSuite) TestDecodeInvalid(c *C) {
 
 }
 
+func (sds *snapDeclSuite) TestSignInvalidSnapIDFormat(c *C) {
+	headers := map[string]string{
+		"authority-id": "canonical",
+		"series":       "16",
+		"snap-id":      "snap_id",
+		"snap-name":    "first",
+		"publisher-id": "dev-id1",
+		"gates":        "",
+		"timestamp":    sds.ts.Format(time.RFC3339),
+	}
+	_, err := asserts.AssembleAndSignInTest(asserts.SnapDeclarationType, headers, nil, testPrivKey0)
+	c.Check(err, ErrorMatches, `"snap-id" header: invalid snap-id: "snap_id"`)
+}
+
 func prereqDevAccount(c *C, storeDB assertstest.SignerDB, db *asserts.Database) {
 	dev1Acct := assertstest.NewAccount(storeDB, "developer1", map[string]string{
 		"account-id": "dev-id1",
@@ -194,6 +242,59 @@ func (sds *snapDeclSuite) TestSnapDeclarationCheckMissingPublisherAccount(c *C)
 	c.Assert(err, ErrorMatches, `snap-declaration assertion for "foo" \(id "snap-id-1"\) does not have a matching account assertion for the publisher "dev-id1"`)
 }
 
+func (sds *snapDeclSuite) TestFindByPublisher(c *C) {
+	storeDB, db := makeStoreAndCheckDB(c)
+
+	prereqDevAccount(c, storeDB, db)
+	dev2Acct := assertstest.NewAccount(storeDB, "developer2", map[string]string{
+		"account-id": "dev-id2",
+	}, "")
+	err := db.Add(dev2Acct)
+	c.Assert(err, IsNil)
+
+	for _, decl := range []struct{ snapID, name, publisherID string }{
+		{"snap-id-1", "foo", "dev-id1"},
+		{"snap-id-2", "bar", "dev-id2"},
+		{"snap-id-3", "baz", "dev-id1"},
+	} {
+		headers := map[string]string{
+			"series":       "16",
+			"snap-id":      decl.snapID,
+			"snap-name":    decl.name,
+			"publisher-id": decl.publisherID,
+			"gates":        "",
+			"timestamp":    time.Now().Format(time.RFC3339),
+		}
+		snapDecl, err := storeDB.Sign(asserts.SnapDeclarationType, headers, nil, "")
+		c.Assert(err, IsNil)
+		err = db.Add(snapDecl)
+		c.Assert(err, IsNil)
+	}
+
+	found, err := db.FindBy(asserts.SnapDeclarationType, "publisher-id", "dev-id1")
+	c.Assert(err, IsNil)
+	var names []string
+	for _, a := range found {
+		names = append(names, a.(*asserts.SnapDeclaration).SnapName())
+	}
+	sort.Strings(names)
+	c.Check(names, DeepEquals, []string{"baz", "foo"})
+
+	found, err = db.FindBy(asserts.SnapDeclarationType, "publisher-id", "dev-id2")
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 1)
+	c.Check(found[0].(*asserts.SnapDeclaration).SnapID(), Equals, "snap-id-2")
+
+	// a primary key header works as well
+	found, err = db.FindBy(asserts.SnapDeclarationType, "snap-id", "snap-id-3")
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 1)
+	c.Check(found[0].(*asserts.SnapDeclaration).SnapName(), Equals, "baz")
+
+	_, err = db.FindBy(asserts.SnapDeclarationType, "publisher-id", "dev-id3")
+	c.Check(err, Equals, asserts.ErrNotFound)
+}
+
 type snapBuildSuite struct {
 	ts     time.Time
 	tsLine string
@@ -518,6 +619,28 @@ func (srs *snapRevSuite) TestSnapRevisionCheckMissingDeclaration(c *C) {
 	c.Assert(err, ErrorMatches, `snap-revision assertion for snap id "snap-id-1" does not have a matching snap-declaration assertion`)
 }
 
+func (srs *snapRevSuite) TestSnapRevisionPrerequisites(c *C) {
+	storeDB, db := makeStoreAndCheckDB(c)
+
+	headers := srs.makeHeaders(nil)
+	snapRev, err := storeDB.Sign(asserts.SnapRevisionType, headers, nil, "")
+	c.Assert(err, IsNil)
+
+	refs, err := asserts.Prerequisites(snapRev, db)
+	c.Assert(err, IsNil)
+	c.Check(refs, DeepEquals, []asserts.Ref{
+		{Type: asserts.AccountType, PrimaryKey: []string{"dev-id1"}},
+		{Type: asserts.SnapDeclarationType, PrimaryKey: []string{"16", "snap-id-1"}},
+	})
+
+	prereqDevAccount(c, storeDB, db)
+	prereqSnapDecl(c, storeDB, db)
+
+	refs, err = asserts.Prerequisites(snapRev, db)
+	c.Assert(err, IsNil)
+	c.Check(refs, HasLen, 0)
+}
+
 func (srs *snapRevSuite) TestPrimaryKey(c *C) {
 	storeDB, db := makeStoreAndCheckDB(c)
 
@@ -537,3 +660,50 @@ func (srs *snapRevSuite) TestPrimaryKey(c *C) {
 	})
 	c.Assert(err, IsNil)
 }
+
+func (srs *snapRevSuite) TestSnapIDs(c *C) {
+	snapDecl := "type: snap-declaration\n" +
+		"authority-id: canonical\n" +
+		"series: 16\n" +
+		"snap-id: snap-id-2\n" +
+		"snap-name: second\n" +
+		"publisher-id: dev-id1\n" +
+		"gates: \n" +
+		srs.tsLine +
+		"body-length: 0" +
+		"\n\n" +
+		"openpgp c2ln"
+	snapBuild := "type: snap-build\n" +
+		"authority-id: dev-id1\n" +
+		"series: 16\n" +
+		"snap-id: snap-id-1\n" +
+		"snap-digest: sha256 ...\n" +
+		"grade: stable\n" +
+		"snap-size: 10000\n" +
+		srs.tsLine +
+		"body-length: 0" +
+		"\n\n" +
+		"openpgp c2ln"
+	testOnly := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: abc" +
+		"\n\n" +
+		"openpgp c2ln"
+	stream := strings.Join([]string{
+		srs.makeValidEncoded(),
+		snapDecl,
+		testOnly,
+		snapBuild,
+	}, "\n\n")
+
+	snapIDs, err := asserts.SnapIDs(strings.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Check(snapIDs, DeepEquals, []string{"snap-id-1", "snap-id-2"})
+
+	snapIDs, err = asserts.SnapIDs(strings.NewReader(testOnly))
+	c.Assert(err, IsNil)
+	c.Check(snapIDs, HasLen, 0)
+
+	_, err = asserts.SnapIDs(strings.NewReader(snapDecl + "\n\ntype: snap-build\n"))
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,88 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// splitEntryPath returns the path under which SplitToDir stores
+// assert: its type name followed by its escaped primary key values,
+// the last one getting a ".assert" suffix.
+func splitEntryPath(assert Assertion) []string {
+	assertType := assert.Type()
+	n := len(assertType.PrimaryKey)
+	comps := make([]string, n+1)
+	comps[0] = assertType.Name
+	// safety against '/' etc
+	for i, k := range assertType.PrimaryKey {
+		comps[i+1] = url.QueryEscape(assert.Header(k))
+	}
+	comps[n] += ".assert"
+	return comps
+}
+
+// SplitToDir reads the stream of assertions from r and writes each
+// of them to its own file under dir, at a path made of its type name
+// and its escaped primary key values, e.g. dir/account/<account-id>.assert.
+// Subdirectories are created as needed and files are written
+// atomically. If dir already holds an assertion with the same primary
+// key, either from the stream itself or from a previous split, the
+// one with the highest revision is kept.
+func SplitToDir(r io.Reader, dir string) error {
+	decoder := NewDecoder(r)
+	for {
+		assert, err := decoder.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := splitWriteEntry(assert, dir); err != nil {
+			return err
+		}
+	}
+}
+
+func splitWriteEntry(assert Assertion, dir string) error {
+	subpath := splitEntryPath(assert)
+	encoded, err := readEntry(dir, subpath...)
+	if err == nil {
+		cur, err := Decode(encoded)
+		if err != nil {
+			return fmt.Errorf("cannot decode assertion already split to %q: %v", filepath.Join(subpath...), err)
+		}
+		if cur.Revision() >= assert.Revision() {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot read assertion already split: %v", err)
+	}
+	err = atomicWriteEntry(Encode(assert), false, dir, subpath...)
+	if err != nil {
+		return fmt.Errorf("cannot write split assertion: %v", err)
+	}
+	return nil
+}
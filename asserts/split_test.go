@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+)
+
+type splitSuite struct{}
+
+var _ = Suite(&splitSuite{})
+
+const (
+	splitA1 = "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: a" +
+		"\n\n" +
+		"openpgp c2ln"
+	splitA2 = "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: b c" +
+		"\n\n" +
+		"openpgp c2ln"
+	splitA3 = "type: test-only-2\n" +
+		"authority-id: auth-id1\n" +
+		"pk1: a\n" +
+		"pk2: b" +
+		"\n\n" +
+		"openpgp c2ln"
+)
+
+func (ss *splitSuite) TestSplitToDir(c *C) {
+	dir := filepath.Join(c.MkDir(), "split")
+	bundle := strings.Join([]string{splitA1, splitA2, splitA3}, "\n\n")
+
+	err := asserts.SplitToDir(strings.NewReader(bundle), dir)
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		path    string
+		encoded string
+	}{
+		{"test-only/a.assert", splitA1},
+		{"test-only/b+c.assert", splitA2},
+		{"test-only-2/a/b.assert", splitA3},
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, t.path))
+		c.Assert(err, IsNil, Commentf("%s", t.path))
+		// assertions from the middle of the stream keep a newline
+		// after their signature
+		c.Check(strings.TrimSuffix(string(content), "\n"), Equals, t.encoded)
+	}
+}
+
+func (ss *splitSuite) TestSplitToDirKeepsHighestRevision(c *C) {
+	dir := c.MkDir()
+	rev1 := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: a\n" +
+		"revision: 1" +
+		"\n\n" +
+		"openpgp c2ln"
+	rev2 := "type: test-only\n" +
+		"authority-id: auth-id1\n" +
+		"primary-key: a\n" +
+		"revision: 2" +
+		"\n\n" +
+		"openpgp c2ln"
+	fpath := filepath.Join(dir, "test-only", "a.assert")
+
+	err := asserts.SplitToDir(strings.NewReader(rev1+"\n\n"+rev2+"\n\n"+splitA1), dir)
+	c.Assert(err, IsNil)
+	content, err := ioutil.ReadFile(fpath)
+	c.Assert(err, IsNil)
+	c.Check(strings.TrimSuffix(string(content), "\n"), Equals, rev2)
+
+	// also across splits
+	err = asserts.SplitToDir(strings.NewReader(rev1), dir)
+	c.Assert(err, IsNil)
+	content, err = ioutil.ReadFile(fpath)
+	c.Assert(err, IsNil)
+	c.Check(strings.TrimSuffix(string(content), "\n"), Equals, rev2)
+}
+
+func (ss *splitSuite) TestSplitToDirDecodeError(c *C) {
+	dir := c.MkDir()
+	err := asserts.SplitToDir(strings.NewReader(splitA1+"\n\n"+"type: test-only\n\nbroken"), dir)
+	c.Check(err, NotNil)
+
+	// what came before was split
+	_, err = os.Stat(filepath.Join(dir, "test-only", "a.assert"))
+	c.Check(err, IsNil)
+}
@@ -0,0 +1,104 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package partition
+
+import (
+	"fmt"
+	"strings"
+)
+
+// blkidEntry holds the details blkid reports for a block device
+type blkidEntry struct {
+	Device string
+	FSType string
+	Label  string
+	UUID   string
+}
+
+// parseBlkidOutput parses the output of blkid in its default format,
+// one device per line like:
+//
+//	/dev/sda1: LABEL="system-boot" UUID="1234-ABCD" TYPE="vfat"
+//
+// Fields missing for a device are left empty, unknown ones are ignored.
+func parseBlkidOutput(output string) ([]blkidEntry, error) {
+	var entries []blkidEntry
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		idx := strings.Index(line, ": ")
+		if idx <= 0 {
+			return nil, fmt.Errorf("cannot parse blkid output line %q: missing device", line)
+		}
+		entry := blkidEntry{Device: line[:idx]}
+		fields, err := parseBlkidFields(line[idx+2:])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse blkid output line %q: %v", line, err)
+		}
+		entry.FSType = fields["TYPE"]
+		entry.Label = fields["LABEL"]
+		entry.UUID = fields["UUID"]
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// parseBlkidFields parses the KEY="value" pairs of a blkid output line,
+// values can contain backslash escaped characters
+func parseBlkidFields(s string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return fields, nil
+		}
+		idx := strings.Index(s, `="`)
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid field %q", s)
+		}
+		key := s[:idx]
+		s = s[idx+2:]
+
+		var value []byte
+		closed := false
+		for i := 0; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s):
+				i++
+				value = append(value, s[i])
+			case s[i] == '"':
+				closed = true
+				s = s[i+1:]
+			default:
+				value = append(value, s[i])
+			}
+			if closed {
+				break
+			}
+		}
+		if !closed {
+			return nil, fmt.Errorf("unterminated value for field %q", key)
+		}
+		fields[key] = string(value)
+	}
+}
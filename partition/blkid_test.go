@@ -0,0 +1,80 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package partition
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type BlkidTestSuite struct {
+}
+
+var _ = Suite(&BlkidTestSuite{})
+
+func (s *BlkidTestSuite) TestParseBlkidOutput(c *C) {
+	output := `/dev/sda1: LABEL="system-boot" UUID="1234-ABCD" TYPE="vfat" PARTUUID="0001-01"
+/dev/sda2: LABEL="writable" UUID="0bd3b9a5-8b4f-4a3b-9d12-0b6a3f1c4e7e" TYPE="ext4"
+`
+	entries, err := parseBlkidOutput(output)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []blkidEntry{
+		{Device: "/dev/sda1", FSType: "vfat", Label: "system-boot", UUID: "1234-ABCD"},
+		{Device: "/dev/sda2", FSType: "ext4", Label: "writable", UUID: "0bd3b9a5-8b4f-4a3b-9d12-0b6a3f1c4e7e"},
+	})
+}
+
+func (s *BlkidTestSuite) TestParseBlkidOutputMissingFields(c *C) {
+	output := `/dev/sda1: UUID="1234-ABCD" TYPE="vfat"
+/dev/sdb: PTTYPE="gpt"
+`
+	entries, err := parseBlkidOutput(output)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []blkidEntry{
+		{Device: "/dev/sda1", FSType: "vfat", UUID: "1234-ABCD"},
+		{Device: "/dev/sdb"},
+	})
+}
+
+func (s *BlkidTestSuite) TestParseBlkidOutputEscapes(c *C) {
+	entries, err := parseBlkidOutput(`/dev/sda3: LABEL="my \"data\" disk" TYPE="ext4"`)
+	c.Assert(err, IsNil)
+	c.Check(entries, DeepEquals, []blkidEntry{
+		{Device: "/dev/sda3", FSType: "ext4", Label: `my "data" disk`},
+	})
+}
+
+func (s *BlkidTestSuite) TestParseBlkidOutputEmpty(c *C) {
+	entries, err := parseBlkidOutput("")
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 0)
+}
+
+func (s *BlkidTestSuite) TestParseBlkidOutputErrors(c *C) {
+	for _, t := range []struct {
+		output, err string
+	}{
+		{`UUID="1234"`, `cannot parse blkid output line "UUID=\\"1234\\"": missing device`},
+		{`/dev/sda1: UUID`, `cannot parse blkid output line .*: invalid field "UUID"`},
+		{`/dev/sda1: UUID="1234`, `cannot parse blkid output line .*: unterminated value for field "UUID"`},
+	} {
+		_, err := parseBlkidOutput(t.output)
+		c.Check(err, ErrorMatches, t.err)
+	}
+}
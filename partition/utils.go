@@ -24,7 +24,14 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/snapcore/snapd/osutil"
 )
 
 // This is a var instead of a function to making mocking in the tests easier
@@ -32,12 +39,39 @@ var runCommand = runCommandImpl
 
 // Run command specified by args and return the output
 func runCommandImpl(args ...string) (string, error) {
+	return runCommandWithEnv(nil, args...)
+}
+
+// Run command specified by args with the given environment and return
+// the output, a nil env means the environment of the current process
+// is inherited
+func runCommandWithEnv(env []string, args ...string) (string, error) {
 	if len(args) == 0 {
 
 		return "", errors.New("no command specified")
 	}
 
 	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	return runCmd(cmd, args)
+}
+
+// Run command specified by args from within the given directory and
+// return the output
+func runCommandInDir(dir string, args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("no command specified")
+	}
+	if !osutil.IsDirectory(dir) {
+		return "", fmt.Errorf("cannot run command %q in %q: not a directory", strings.Join(args, " "), dir)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	return runCmd(cmd, args)
+}
+
+func runCmd(cmd *exec.Cmd, args []string) (string, error) {
 	stdout := bytes.NewBuffer(nil)
 	stderr := bytes.NewBuffer(nil)
 	cmd.Stdout = stdout
@@ -50,3 +84,82 @@ func runCommandImpl(args ...string) (string, error) {
 
 	return stdout.String(), err
 }
+
+// Run command specified by args and return the output, the command,
+// together with any process it started, is killed if ctx is cancelled
+// or expires before it finishes, the output collected until then is
+// returned together with the ctx error
+func runCommandWithStdoutContext(ctx context.Context, args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("no command specified")
+	}
+
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// run it in its own process group, so that on cancellation its
+	// children, that could hold on to its output, are killed too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmdline := strings.Join(args, " ")
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to run command %q: %q (%s)", cmdline, stderr, err)
+	}
+
+	waitDone := make(chan error, 1)
+	go func() {
+		waitDone <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-waitDone:
+		if err != nil {
+			return stdout.String(), fmt.Errorf("failed to run command %q: %q (%s)", cmdline, stderr, err)
+		}
+		return stdout.String(), nil
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		// wait for the output to be fully collected
+		<-waitDone
+		return stdout.String(), ctx.Err()
+	}
+}
+
+// Run command specified by args and return its combined stdout and
+// stderr output, also when it succeeds
+func runCommandCombined(args ...string) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no command specified")
+	}
+
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		cmdline := strings.Join(args, " ")
+		return output, fmt.Errorf("failed to run command %q: %q (%s)", cmdline, output, err)
+	}
+
+	return output, nil
+}
+
+var (
+	// how many times runCommandWithRetry tries a command at most
+	commandRetryAttempts = 5
+	// how long runCommandWithRetry waits between attempts
+	commandRetryDelay = 1 * time.Second
+)
+
+// Run command specified by args via runCommand, retrying it after a
+// delay while it fails with an error matching retryable (e.g. "device
+// busy") up to commandRetryAttempts times overall
+func runCommandWithRetry(retryable *regexp.Regexp, args ...string) (string, error) {
+	var output string
+	var err error
+	for attempt := 1; ; attempt++ {
+		output, err = runCommand(args...)
+		if err == nil || !retryable.MatchString(err.Error()) || attempt >= commandRetryAttempts {
+			return output, err
+		}
+		time.Sleep(commandRetryDelay)
+	}
+}
@@ -20,6 +20,14 @@
 package partition
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"golang.org/x/net/context"
 	. "gopkg.in/check.v1"
 )
 
@@ -49,3 +57,150 @@ func (s *UtilsTestSuite) TestRunCommandWithStdoutReturnsStdout(c *C) {
 	c.Assert(output, Matches, "stdout")
 	c.Assert(err, ErrorMatches, `failed to run command \".*\": \"stderr\" \(exit status 1\)`)
 }
+
+func (s *UtilsTestSuite) TestRunCommandWithStdoutContext(c *C) {
+	output, err := runCommandWithStdoutContext(context.Background(), "sh", "-c", "printf 'foo\nbar'")
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "foo\nbar")
+
+	_, err = runCommandWithStdoutContext(context.Background(), "sh", "-c", "printf 'stderr' >&2; false")
+	c.Check(err, ErrorMatches, `failed to run command \".*\": \"stderr\" \(exit status 1\)`)
+}
+
+func (s *UtilsTestSuite) TestRunCommandWithStdoutContextCancelled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	output, err := runCommandWithStdoutContext(ctx, "sh", "-c", "echo partial; exec sleep 10")
+	c.Check(err, Equals, context.Canceled)
+	c.Check(output, Equals, "partial\n")
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (s *UtilsTestSuite) TestRunCommandWithStdoutContextCancelledKillsChildren(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	// sleep runs as a child of the shell, holding on to its stdout
+	output, err := runCommandWithStdoutContext(ctx, "sh", "-c", "echo partial; sleep 10; true")
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(output, Equals, "partial\n")
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (s *UtilsTestSuite) TestRunCommandWithStdoutContextNoCommand(c *C) {
+	_, err := runCommandWithStdoutContext(context.Background())
+	c.Check(err, ErrorMatches, "no command specified")
+}
+
+func (s *UtilsTestSuite) TestRunCommandCombined(c *C) {
+	output, err := runCommandCombined("sh", "-c", "printf stdout; printf stderr >&2")
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "stdoutstderr")
+}
+
+func (s *UtilsTestSuite) TestRunCommandCombinedFails(c *C) {
+	output, err := runCommandCombined("sh", "-c", "printf stdout; printf stderr >&2; false")
+	c.Assert(string(output), Equals, "stdoutstderr")
+	c.Assert(err, ErrorMatches, `failed to run command \".*\": \"stdoutstderr\" \(exit status 1\)`)
+}
+
+func (s *UtilsTestSuite) TestRunCommandCombinedNoCommand(c *C) {
+	_, err := runCommandCombined()
+	c.Assert(err, ErrorMatches, "no command specified")
+}
+
+func (s *UtilsTestSuite) TestRunCommandWithEnv(c *C) {
+	output, err := runCommandWithEnv([]string{"LANG=C", "FOO=bar"}, "sh", "-c", "printf \"$LANG $FOO\"")
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "C bar")
+}
+
+func (s *UtilsTestSuite) TestRunCommandWithEnvNilInherits(c *C) {
+	os.Setenv("SNAPD_PARTITION_TEST", "inherited")
+	defer os.Unsetenv("SNAPD_PARTITION_TEST")
+
+	output, err := runCommandWithEnv(nil, "sh", "-c", "printf \"$SNAPD_PARTITION_TEST\"")
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "inherited")
+}
+
+func (s *UtilsTestSuite) TestRunCommandInDir(c *C) {
+	dir := c.MkDir()
+	output, err := runCommandInDir(dir, "pwd")
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, dir+"\n")
+
+	// relative paths are resolved from there
+	err = ioutil.WriteFile(filepath.Join(dir, "foo"), []byte("foo-content"), 0644)
+	c.Assert(err, IsNil)
+	output, err = runCommandInDir(dir, "cat", "foo")
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "foo-content")
+}
+
+func (s *UtilsTestSuite) TestRunCommandInDirMissing(c *C) {
+	dir := filepath.Join(c.MkDir(), "missing")
+	_, err := runCommandInDir(dir, "true")
+	c.Assert(err, ErrorMatches, `cannot run command "true" in ".*/missing": not a directory`)
+}
+
+func (s *UtilsTestSuite) mockRetry(c *C, outcomes []error) (calls *int, restore func()) {
+	oldRunCommand := runCommand
+	oldDelay := commandRetryDelay
+	commandRetryDelay = time.Millisecond
+	calls = new(int)
+	runCommand = func(args ...string) (string, error) {
+		c.Check(args, DeepEquals, []string{"partprobe", "/dev/sda"})
+		err := outcomes[*calls]
+		*calls++
+		if err != nil {
+			return "", err
+		}
+		return "ok", nil
+	}
+	return calls, func() {
+		runCommand = oldRunCommand
+		commandRetryDelay = oldDelay
+	}
+}
+
+var deviceBusy = regexp.MustCompile("[Dd]evice or resource busy")
+
+func (s *UtilsTestSuite) TestRunCommandWithRetryFailsOnce(c *C) {
+	calls, restore := s.mockRetry(c, []error{errors.New("partprobe: Device or resource busy"), nil})
+	defer restore()
+
+	output, err := runCommandWithRetry(deviceBusy, "partprobe", "/dev/sda")
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "ok")
+	c.Check(*calls, Equals, 2)
+}
+
+func (s *UtilsTestSuite) TestRunCommandWithRetryNotRetryable(c *C) {
+	calls, restore := s.mockRetry(c, []error{errors.New("partprobe: no such device"), nil})
+	defer restore()
+
+	_, err := runCommandWithRetry(deviceBusy, "partprobe", "/dev/sda")
+	c.Assert(err, ErrorMatches, "partprobe: no such device")
+	c.Check(*calls, Equals, 1)
+}
+
+func (s *UtilsTestSuite) TestRunCommandWithRetryGivesUp(c *C) {
+	busy := errors.New("partprobe: Device or resource busy")
+	outcomes := make([]error, commandRetryAttempts+1)
+	for i := range outcomes {
+		outcomes[i] = busy
+	}
+	calls, restore := s.mockRetry(c, outcomes)
+	defer restore()
+
+	_, err := runCommandWithRetry(deviceBusy, "partprobe", "/dev/sda")
+	c.Assert(err, Equals, busy)
+	c.Check(*calls, Equals, commandRetryAttempts)
+}
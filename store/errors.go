@@ -41,6 +41,15 @@ var (
 	// ErrAssertionNotFound is returned when an assertion can not be found
 	ErrAssertionNotFound = errors.New("assertion not found")
 
+	// ErrAssertionNotModified is returned when the store reports that the assertion already held by the client is current
+	ErrAssertionNotModified = errors.New("assertion not modified")
+
+	// ErrBadAssertion is returned when the store rejects a pushed assertion as invalid
+	ErrBadAssertion = errors.New("assertion rejected as invalid")
+
+	// ErrAssertionConflict is returned when a pushed assertion conflicts with one already in the store
+	ErrAssertionConflict = errors.New("assertion conflicts with one already in the store")
+
 	// ErrAuthenticationNeeds2fa is returned if the authentication needs 2factor
 	ErrAuthenticationNeeds2fa = errors.New("two factor authentication required")
 
@@ -51,6 +60,16 @@ var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 )
 
+// ErrMalformedSSHKey represents a user ssh key that cannot be parsed
+type ErrMalformedSSHKey struct {
+	Key string
+	Err error
+}
+
+func (e *ErrMalformedSSHKey) Error() string {
+	return fmt.Sprintf("cannot parse ssh key %q: %v", e.Key, e.Err)
+}
+
 // ErrDownload represents a download error
 type ErrDownload struct {
 	Code int
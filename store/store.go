@@ -26,13 +26,21 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 
 	"github.com/snapcore/snapd/arch"
 	"github.com/snapcore/snapd/asserts"
@@ -104,6 +112,8 @@ type Config struct {
 	AssertionsURI     *url.URL
 	PurchasesURI      *url.URL
 	PaymentMethodsURI *url.URL
+	DeviceNonceURI    *url.URL
+	DeviceSessionURI  *url.URL
 	DetailFields      []string
 }
 
@@ -116,6 +126,8 @@ type Store struct {
 	assertionsURI     *url.URL
 	purchasesURI      *url.URL
 	paymentMethodsURI *url.URL
+	deviceNonceURI    *url.URL
+	deviceSessionURI  *url.URL
 
 	detailFields []string
 	// reused http client
@@ -243,6 +255,16 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	defaultConfig.DeviceNonceURI, err = url.Parse(myappsURL() + "api/v1/snaps/auth/nonces")
+	if err != nil {
+		panic(err)
+	}
+
+	defaultConfig.DeviceSessionURI, err = url.Parse(myappsURL() + "api/v1/snaps/auth/sessions")
+	if err != nil {
+		panic(err)
+	}
 }
 
 type searchResults struct {
@@ -295,6 +317,8 @@ func New(cfg *Config, storeID string, authContext auth.AuthContext) *Store {
 		assertionsURI:     cfg.AssertionsURI,
 		purchasesURI:      cfg.PurchasesURI,
 		paymentMethodsURI: cfg.PaymentMethodsURI,
+		deviceNonceURI:    cfg.DeviceNonceURI,
+		deviceSessionURI:  cfg.DeviceSessionURI,
 		detailFields:      fields,
 		client:            newHTTPClient(),
 		authContext:       authContext,
@@ -890,6 +914,32 @@ type assertionSvcError struct {
 
 // Assertion retrivies the assertion for the given type and primary key.
 func (s *Store) Assertion(assertType *asserts.AssertionType, primaryKey []string, user *auth.UserState) (asserts.Assertion, error) {
+	return s.fetchAssertion(assertType, primaryKey, -1, user)
+}
+
+// AssertionIfModified is like Assertion but it makes the request
+// conditional on the assertion having a revision different from
+// knownRevision, the one already held by the caller. It returns
+// ErrAssertionNotModified if the store answers that the caller copy
+// is current, or if it returns a revision not newer than it.
+func (s *Store) AssertionIfModified(assertType *asserts.AssertionType, primaryKey []string, knownRevision int, user *auth.UserState) (asserts.Assertion, error) {
+	a, err := s.fetchAssertion(assertType, primaryKey, knownRevision, user)
+	if err != nil {
+		return nil, err
+	}
+	if a.Revision() <= knownRevision {
+		return nil, ErrAssertionNotModified
+	}
+	return a, nil
+}
+
+// revisionETag returns the entity tag used in conditional requests
+// for an assertion revision.
+func revisionETag(revision int) string {
+	return fmt.Sprintf(`"%d"`, revision)
+}
+
+func (s *Store) fetchAssertion(assertType *asserts.AssertionType, primaryKey []string, knownRevision int, user *auth.UserState) (asserts.Assertion, error) {
 	url, err := s.assertionsURI.Parse(path.Join(assertType.Name, path.Join(primaryKey...)))
 	if err != nil {
 		return nil, err
@@ -900,6 +950,10 @@ func (s *Store) Assertion(assertType *asserts.AssertionType, primaryKey []string
 		return nil, err
 	}
 	req.Header.Set("Accept", asserts.MediaType)
+	setAssertionsFormatHint(req)
+	if knownRevision >= 0 {
+		req.Header.Set("If-None-Match", revisionETag(knownRevision))
+	}
 
 	resp, err := s.client.Do(req)
 	if err != nil {
@@ -907,6 +961,9 @@ func (s *Store) Assertion(assertType *asserts.AssertionType, primaryKey []string
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 304 && knownRevision >= 0 {
+		return nil, ErrAssertionNotModified
+	}
 	if resp.StatusCode != 200 {
 		if resp.Header.Get("Content-Type") == "application/json" {
 			var svcErr assertionSvcError
@@ -919,12 +976,232 @@ func (s *Store) Assertion(assertType *asserts.AssertionType, primaryKey []string
 			}
 			return nil, fmt.Errorf("assertion service error: [%s] %q", svcErr.Title, svcErr.Detail)
 		}
+		if resp.StatusCode == 404 {
+			return nil, ErrAssertionNotFound
+		}
 		return nil, respToError(resp, "fetch assertion")
 	}
 
 	// and decode assertion
 	dec := asserts.NewDecoder(resp.Body)
-	return dec.Decode()
+	a, err := dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if a.Type() != assertType {
+		return nil, fmt.Errorf("cannot fetch assertion: got %q assertion instead of %q", a.Type().Name, assertType.Name)
+	}
+	return a, nil
+}
+
+// MultipartAssertion extracts and decodes the assertion carried in
+// the part with asserts.MediaType content type of a multipart body
+// with the given Content-Type. Other parts are skipped.
+func MultipartAssertion(contentType string, body io.Reader) (asserts.Assertion, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse multipart content type: %v", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("expected a multipart body, got %q", mediaType)
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("cannot find %s part in multipart body", asserts.MediaType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read multipart body: %v", err)
+		}
+		partType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || partType != asserts.MediaType {
+			continue
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read assertion part: %v", err)
+		}
+		return asserts.Decode(data)
+	}
+}
+
+// maxAssertionsFormat is the highest assertions format the client
+// can parse, older clients must avoid fetching newer formats.
+var maxAssertionsFormat = 0
+
+// assertionsFormatHeader carries the maximum assertions format
+// supported by the client in requests and by the assertions service
+// in responses.
+const assertionsFormatHeader = "X-Ubuntu-Assertions-Max-Format"
+
+func setAssertionsFormatHint(req *http.Request) {
+	req.Header.Set(assertionsFormatHeader, strconv.Itoa(maxAssertionsFormat))
+}
+
+// AssertionsFormat negotiates with the assertions service the
+// assertions format to use: the highest one supported by both the
+// client and the service, which advertises its maximum via a response
+// header, assumed to be 0 if missing.
+func (s *Store) AssertionsFormat(ctx context.Context) (int, error) {
+	req, err := http.NewRequest("HEAD", s.assertionsURI.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	setAssertionsFormatHint(req)
+
+	resp, err := ctxhttp.Do(ctx, s.client, req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, respToError(resp, "query assertions format")
+	}
+
+	formatStr := resp.Header.Get(assertionsFormatHeader)
+	if formatStr == "" {
+		return 0, nil
+	}
+	serviceFormat, err := strconv.Atoi(formatStr)
+	if err != nil || serviceFormat < 0 {
+		return 0, fmt.Errorf("cannot query assertions format: invalid %s header: %q", assertionsFormatHeader, formatStr)
+	}
+	if serviceFormat < maxAssertionsFormat {
+		return serviceFormat, nil
+	}
+	return maxAssertionsFormat, nil
+}
+
+var (
+	listMaxAttempts    = 5
+	listInitialBackoff = 500 * time.Millisecond
+	linkNextRelRegexp  = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?next"?`)
+)
+
+// Assertions retrieves the assertions of the given type matching the
+// headers, transparently following the pagination of the assertions
+// service. foundCb is invoked for each assertion as soon as it is
+// decoded, an error from it stops the retrieval and is returned.
+// Requests answered with 429 or 5xx status codes are retried with
+// exponential backoff.
+func (s *Store) Assertions(ctx context.Context, assertType *asserts.AssertionType, headers map[string]string, user *auth.UserState, foundCb func(asserts.Assertion) error) error {
+	u, err := s.assertionsURI.Parse(assertType.Name)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	for k, v := range headers {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+
+	next := u.String()
+	for next != "" {
+		resp, err := s.listAssertionsPage(ctx, next, user)
+		if err != nil {
+			return err
+		}
+		next, err = nextPageURL(resp)
+		if err == nil {
+			dec := asserts.NewDecoder(resp.Body)
+			for {
+				var a asserts.Assertion
+				a, err = dec.Decode()
+				if err == io.EOF {
+					err = nil
+					break
+				}
+				if err != nil {
+					break
+				}
+				if err = foundCb(a); err != nil {
+					break
+				}
+			}
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) listAssertionsPage(ctx context.Context, pageURL string, user *auth.UserState) (*http.Response, error) {
+	backoff := listInitialBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := s.newRequest("GET", pageURL, nil, user)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", asserts.MediaType)
+		setAssertionsFormatHint(req)
+
+		resp, err := ctxhttp.Do(ctx, s.client, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == 200 {
+			return resp, nil
+		}
+		if (resp.StatusCode != 429 && resp.StatusCode < 500) || attempt == listMaxAttempts {
+			resp.Body.Close()
+			return nil, respToError(resp, "list assertions")
+		}
+		resp.Body.Close()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// nextPageURL returns the URL of the next page as indicated by a
+// rel="next" Link header, or "" if there is none.
+func nextPageURL(resp *http.Response) (string, error) {
+	for _, link := range resp.Header["Link"] {
+		m := linkNextRelRegexp.FindStringSubmatch(link)
+		if m == nil {
+			continue
+		}
+		u, err := resp.Request.URL.Parse(m[1])
+		if err != nil {
+			return "", fmt.Errorf("cannot parse next page link: %v", err)
+		}
+		return u.String(), nil
+	}
+	return "", nil
+}
+
+// Push uploads the signed assertion to the store assertions service.
+func (s *Store) Push(ctx context.Context, assert asserts.Assertion, user *auth.UserState) error {
+	req, err := s.newRequest("POST", s.assertionsURI.String(), bytes.NewReader(asserts.Encode(assert)), user)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", asserts.MediaType)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ctxhttp.Do(ctx, s.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200, 201:
+		return nil
+	case 400:
+		return ErrBadAssertion
+	case 409:
+		return ErrAssertionConflict
+	}
+	return respToError(resp, "push assertion")
 }
 
 // SuggestedCurrency retrieves the cached value for the store's suggested currency
@@ -1163,3 +1440,117 @@ func (s *Store) PaymentMethods(user *auth.UserState) (*PaymentInformation, error
 		return nil, fmt.Errorf("cannot get payment methods: unexpected HTTP code %d%s", resp.StatusCode, details)
 	}
 }
+
+// requestDeviceNonce obtains from the store a nonce to be signed by the
+// device to authenticate.
+func (s *Store) requestDeviceNonce() (string, error) {
+	req, err := s.newRequest("POST", s.deviceNonceURI.String(), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", respToError(resp, "obtain device nonce")
+	}
+
+	var responseData struct {
+		Nonce string `json:"nonce"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&responseData); err != nil {
+		return "", fmt.Errorf("cannot decode device nonce: %v", err)
+	}
+	if responseData.Nonce == "" {
+		return "", fmt.Errorf("cannot obtain device nonce: empty nonce returned")
+	}
+	return responseData.Nonce, nil
+}
+
+// signDeviceSessionRequest builds a device-session-request for the
+// device identified by serial answering nonce and signs it with the
+// device key.
+func signDeviceSessionRequest(serial *asserts.Serial, deviceKey asserts.PrivateKey, nonce string) (asserts.Assertion, error) {
+	if deviceKey.PublicKey().ID() != serial.DeviceKey().ID() {
+		return nil, fmt.Errorf("device key does not match the one in the serial assertion")
+	}
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.ImportKey(serial.BrandID(), deviceKey)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		"authority-id": serial.BrandID(),
+		"brand-id":     serial.BrandID(),
+		"model":        serial.Model(),
+		"serial":       serial.Serial(),
+		"nonce":        nonce,
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+	}
+	return db.Sign(asserts.DeviceSessionRequestType, headers, nil, deviceKey.PublicKey().ID())
+}
+
+// DeviceSession performs the device authentication handshake with the
+// store for the device identified by the serial assertion: it signs
+// with the device key a device-session-request answering a nonce
+// obtained from the store and exchanges it, together with the serial
+// assertion, for a device session macaroon which is returned.
+func (s *Store) DeviceSession(serial *asserts.Serial, deviceKey asserts.PrivateKey) (string, error) {
+	nonce, err := s.requestDeviceNonce()
+	if err != nil {
+		return "", err
+	}
+
+	sessionRequest, err := signDeviceSessionRequest(serial, deviceKey, nonce)
+	if err != nil {
+		return "", fmt.Errorf("cannot sign device session request: %v", err)
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"serial-assertion":       string(asserts.Encode(serial)),
+		"device-session-request": string(asserts.Encode(sessionRequest)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := s.newRequest("POST", s.deviceSessionURI.String(), bytes.NewReader(data), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", respToError(resp, "obtain device session")
+	}
+
+	var responseData struct {
+		Macaroon string `json:"macaroon"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&responseData); err != nil {
+		return "", fmt.Errorf("cannot decode device session: %v", err)
+	}
+	if responseData.Macaroon == "" {
+		return "", fmt.Errorf("cannot obtain device session: empty macaroon returned")
+	}
+	return responseData.Macaroon, nil
+}
@@ -25,17 +25,22 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/net/context"
 	. "gopkg.in/check.v1"
 	"gopkg.in/macaroon.v1"
 
 	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
 	"github.com/snapcore/snapd/dirs"
 	"github.com/snapcore/snapd/logger"
 	"github.com/snapcore/snapd/osutil"
@@ -1268,6 +1273,145 @@ func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertion(c *C) {
 	c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
 }
 
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertionNotModified(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/assertions/snap-declaration/16/snapidfoo")
+		c.Check(r.Header.Get("If-None-Match"), Equals, `"3"`)
+		w.WriteHeader(304)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	_, err = repo.AssertionIfModified(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, 3, nil)
+	c.Check(err, Equals, ErrAssertionNotModified)
+}
+
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertionModified(c *C) {
+	newer := strings.Replace(testAssertion, "authority-id: super\n", "authority-id: super\nrevision: 4\n", 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/assertions/snap-declaration/16/snapidfoo")
+		c.Check(r.Header.Get("If-None-Match"), Matches, `"[34]"`)
+		io.WriteString(w, newer)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	a, err := repo.AssertionIfModified(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, 3, nil)
+	c.Assert(err, IsNil)
+	c.Check(a.Revision(), Equals, 4)
+
+	// a server ignoring the condition returning the known revision
+	_, err = repo.AssertionIfModified(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, 4, nil)
+	c.Check(err, Equals, ErrAssertionNotModified)
+}
+
+func (t *remoteRepoTestSuite) TestMultipartAssertion(c *C) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	jsonPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	c.Assert(err, IsNil)
+	io.WriteString(jsonPart, `{"snap-name": "mysnap"}`)
+	assertPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {asserts.MediaType}})
+	c.Assert(err, IsNil)
+	io.WriteString(assertPart, testAssertion)
+	c.Assert(mw.Close(), IsNil)
+
+	a, err := MultipartAssertion(mw.FormDataContentType(), &buf)
+	c.Assert(err, IsNil)
+	c.Check(a.Type(), Equals, asserts.SnapDeclarationType)
+	c.Check(a.Header("snap-id"), Equals, "snapidfoo")
+}
+
+func (t *remoteRepoTestSuite) TestMultipartAssertionMissing(c *C) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	jsonPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	c.Assert(err, IsNil)
+	io.WriteString(jsonPart, `{"snap-name": "mysnap"}`)
+	c.Assert(mw.Close(), IsNil)
+
+	_, err = MultipartAssertion(mw.FormDataContentType(), &buf)
+	c.Check(err, ErrorMatches, `cannot find application/x.ubuntu.assertion part in multipart body`)
+
+	_, err = MultipartAssertion("application/json", &buf)
+	c.Check(err, ErrorMatches, `expected a multipart body, got "application/json"`)
+}
+
+func (t *remoteRepoTestSuite) TestAssertionsFormat(c *C) {
+	oldMaxFormat := maxAssertionsFormat
+	defer func() { maxAssertionsFormat = oldMaxFormat }()
+	maxAssertionsFormat = 1
+
+	advertised := ""
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "HEAD")
+		c.Check(r.URL.Path, Equals, "/assertions/")
+		c.Check(r.Header.Get("X-Ubuntu-Assertions-Max-Format"), Equals, "1")
+		if advertised != "" {
+			w.Header().Set("X-Ubuntu-Assertions-Max-Format", advertised)
+		}
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	repo := New(&Config{AssertionsURI: assertionsURI}, "", nil)
+
+	for _, test := range []struct {
+		advertised string
+		expected   int
+	}{
+		// the service supports newer formats than the client
+		{"2", 1},
+		{"1", 1},
+		// the service is older
+		{"0", 0},
+		{"", 0},
+	} {
+		advertised = test.advertised
+		format, err := repo.AssertionsFormat(context.TODO())
+		c.Assert(err, IsNil)
+		c.Check(format, Equals, test.expected)
+	}
+
+	advertised = "x"
+	_, err = repo.AssertionsFormat(context.TODO())
+	c.Check(err, ErrorMatches, `cannot query assertions format: invalid X-Ubuntu-Assertions-Max-Format header: "x"`)
+}
+
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertionSendsFormatHint(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("X-Ubuntu-Assertions-Max-Format"), Equals, "0")
+		io.WriteString(w, testAssertion)
+	}))
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	repo := New(&Config{AssertionsURI: assertionsURI}, "", nil)
+
+	_, err = repo.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	c.Assert(err, IsNil)
+}
+
 func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertionSetsAuth(c *C) {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// check authorization is set
@@ -1318,6 +1462,187 @@ func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryNotFound(c *C) {
 	c.Check(err, Equals, ErrAssertionNotFound)
 }
 
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryNotFoundPlain(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/assertions/snap-declaration/16/snapidfoo")
+		w.WriteHeader(404)
+		io.WriteString(w, "not found")
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	_, err = repo.Assertion(asserts.SnapDeclarationType, []string{"16", "snapidfoo"}, nil)
+	c.Check(err, Equals, ErrAssertionNotFound)
+}
+
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertionWrongType(c *C) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testAssertion)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	_, err = repo.Assertion(asserts.SnapRevisionType, []string{"16", "snapidfoo", "sha256 ..."}, nil)
+	c.Check(err, ErrorMatches, `cannot fetch assertion: got "snap-declaration" assertion instead of "snap-revision"`)
+}
+
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertionsPaginated(c *C) {
+	restore := listInitialBackoff
+	listInitialBackoff = time.Millisecond
+	defer func() { listInitialBackoff = restore }()
+
+	otherAssertion := strings.Replace(testAssertion, "snapidfoo", "snapidbar", 1)
+
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Accept"), Equals, asserts.MediaType)
+		switch n {
+		case 0:
+			c.Check(r.URL.Path, Equals, "/assertions/snap-declaration")
+			c.Check(r.URL.Query().Get("publisher-id"), Equals, "devidbaz")
+			w.Header().Set("Link", `</assertions/snap-declaration?publisher-id=devidbaz&page=2>; rel="next"`)
+			io.WriteString(w, testAssertion)
+		case 1:
+			w.WriteHeader(503)
+		case 2:
+			c.Check(r.URL.Query().Get("page"), Equals, "2")
+			io.WriteString(w, otherAssertion)
+		default:
+			c.Fatalf("expected to get 3 requests, now on %d", n+1)
+		}
+		n++
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	var snapIDs []string
+	err = repo.Assertions(context.TODO(), asserts.SnapDeclarationType, map[string]string{"publisher-id": "devidbaz"}, nil, func(a asserts.Assertion) error {
+		snapIDs = append(snapIDs, a.Header("snap-id"))
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Check(snapIDs, DeepEquals, []string{"snapidfoo", "snapidbar"})
+	c.Check(n, Equals, 3)
+}
+
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryAssertionsGivesUp(c *C) {
+	restore := listInitialBackoff
+	listInitialBackoff = time.Millisecond
+	defer func() { listInitialBackoff = restore }()
+
+	n := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.WriteHeader(429)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	err = repo.Assertions(context.TODO(), asserts.SnapDeclarationType, nil, nil, func(a asserts.Assertion) error {
+		c.Fatalf("unexpected assertion")
+		return nil
+	})
+	c.Check(err, ErrorMatches, "cannot list assertions: got unexpected HTTP status code 429 .*")
+	c.Check(n, Equals, listMaxAttempts)
+}
+
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryPush(c *C) {
+	a, err := asserts.Decode([]byte(testAssertion))
+	c.Assert(err, IsNil)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "POST")
+		c.Check(r.URL.Path, Equals, "/assertions/")
+		c.Check(r.Header.Get("Content-Type"), Equals, asserts.MediaType)
+		pushed, err := asserts.NewDecoder(r.Body).Decode()
+		c.Assert(err, IsNil)
+		c.Check(asserts.Encode(pushed), DeepEquals, asserts.Encode(a))
+		w.WriteHeader(201)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	err = repo.Push(context.TODO(), a, nil)
+	c.Assert(err, IsNil)
+}
+
+func (t *remoteRepoTestSuite) TestUbuntuStoreRepositoryPushErrors(c *C) {
+	a, err := asserts.Decode([]byte(testAssertion))
+	c.Assert(err, IsNil)
+
+	var status int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	c.Assert(mockServer, NotNil)
+	defer mockServer.Close()
+
+	assertionsURI, err := url.Parse(mockServer.URL + "/assertions/")
+	c.Assert(err, IsNil)
+	cfg := Config{
+		AssertionsURI: assertionsURI,
+	}
+	repo := New(&cfg, "", nil)
+
+	status = 400
+	err = repo.Push(context.TODO(), a, nil)
+	c.Check(err, Equals, ErrBadAssertion)
+
+	status = 409
+	err = repo.Push(context.TODO(), a, nil)
+	c.Check(err, Equals, ErrAssertionConflict)
+
+	status = 500
+	err = repo.Push(context.TODO(), a, nil)
+	c.Check(err, ErrorMatches, "cannot push assertion: got unexpected HTTP status code 500 .*")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = repo.Push(ctx, a, nil)
+	c.Check(err, Equals, context.Canceled)
+}
+
 func (t *remoteRepoTestSuite) TestUbuntuStoreRepositorySuggestedCurrency(c *C) {
 	suggestedCurrency := "GBP"
 
@@ -2045,3 +2370,122 @@ func (t *remoteRepoTestSuite) TestUbuntuStorePaymentMethods(c *C) {
 
 	c.Check(purchaseServerGetCalled, Equals, 1)
 }
+
+func (t *remoteRepoTestSuite) TestDeviceSession(c *C) {
+	rootKey, _ := assertstest.GenerateKey(1024)
+	storeKey, _ := assertstest.GenerateKey(1024)
+	deviceKey, _ := assertstest.GenerateKey(1024)
+	storeStack := assertstest.NewStoreStack("canonical", rootKey, storeKey)
+
+	encodedDevKey, err := asserts.EncodePublicKey(deviceKey.PublicKey())
+	c.Assert(err, IsNil)
+	serial, err := storeStack.Sign(asserts.SerialType, map[string]string{
+		"brand-id":   "my-brand",
+		"model":      "my-model",
+		"serial":     "9999",
+		"device-key": string(encodedDevKey),
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	// the server side checks the device-session-request with the
+	// device key through a matching account-key
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore:      asserts.NewMemoryBackstore(),
+		KeypairManager: asserts.NewMemoryKeypairManager(),
+		Trusted:        storeStack.Trusted,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(db.Add(storeStack.StoreAccountKey("")), IsNil)
+	brandAcct := assertstest.NewAccount(storeStack, "my-brand", map[string]string{
+		"account-id": "my-brand",
+	}, "")
+	c.Assert(db.Add(brandAcct), IsNil)
+	devAccKey := assertstest.NewAccountKey(storeStack.RootSigning, brandAcct, nil, deviceKey.PublicKey(), "")
+	c.Assert(db.Add(devAccKey), IsNil)
+
+	const nonce = "@@nonce@@"
+	var nonceCalls, sessionCalls int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "POST")
+		switch r.URL.Path {
+		case "/api/v1/snaps/auth/nonces":
+			nonceCalls++
+			io.WriteString(w, `{"nonce": "`+nonce+`"}`)
+		case "/api/v1/snaps/auth/sessions":
+			sessionCalls++
+			c.Check(r.Header.Get("Content-Type"), Equals, "application/json")
+			var data map[string]string
+			err := json.NewDecoder(r.Body).Decode(&data)
+			c.Assert(err, IsNil)
+
+			sentSerial, err := asserts.Decode([]byte(data["serial-assertion"]))
+			c.Assert(err, IsNil)
+			c.Check(asserts.Encode(sentSerial), DeepEquals, asserts.Encode(serial))
+
+			a, err := asserts.Decode([]byte(data["device-session-request"]))
+			c.Assert(err, IsNil)
+			req, ok := a.(*asserts.DeviceSessionRequest)
+			c.Assert(ok, Equals, true)
+			c.Check(req.BrandID(), Equals, "my-brand")
+			c.Check(req.Model(), Equals, "my-model")
+			c.Check(req.Serial(), Equals, "9999")
+			c.Check(req.Nonce(), Equals, nonce)
+			c.Check(db.Check(req), IsNil)
+
+			io.WriteString(w, `{"macaroon": "device-session-macaroon"}`)
+		default:
+			c.Errorf("unexpected path %q", r.URL.Path)
+		}
+	}))
+	defer mockServer.Close()
+
+	nonceURI, err := url.Parse(mockServer.URL + "/api/v1/snaps/auth/nonces")
+	c.Assert(err, IsNil)
+	sessionURI, err := url.Parse(mockServer.URL + "/api/v1/snaps/auth/sessions")
+	c.Assert(err, IsNil)
+	repo := New(&Config{
+		DeviceNonceURI:   nonceURI,
+		DeviceSessionURI: sessionURI,
+	}, "", nil)
+
+	macaroon, err := repo.DeviceSession(serial.(*asserts.Serial), deviceKey)
+	c.Assert(err, IsNil)
+	c.Check(macaroon, Equals, "device-session-macaroon")
+	c.Check(nonceCalls, Equals, 1)
+	c.Check(sessionCalls, Equals, 1)
+}
+
+func (t *remoteRepoTestSuite) TestDeviceSessionWrongDeviceKey(c *C) {
+	rootKey, _ := assertstest.GenerateKey(1024)
+	storeKey, _ := assertstest.GenerateKey(1024)
+	deviceKey, _ := assertstest.GenerateKey(1024)
+	otherKey, _ := assertstest.GenerateKey(1024)
+	storeStack := assertstest.NewStoreStack("canonical", rootKey, storeKey)
+
+	encodedDevKey, err := asserts.EncodePublicKey(deviceKey.PublicKey())
+	c.Assert(err, IsNil)
+	serial, err := storeStack.Sign(asserts.SerialType, map[string]string{
+		"brand-id":   "my-brand",
+		"model":      "my-model",
+		"serial":     "9999",
+		"device-key": string(encodedDevKey),
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+	}, nil, "")
+	c.Assert(err, IsNil)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/api/v1/snaps/auth/nonces")
+		io.WriteString(w, `{"nonce": "@@nonce@@"}`)
+	}))
+	defer mockServer.Close()
+
+	nonceURI, err := url.Parse(mockServer.URL + "/api/v1/snaps/auth/nonces")
+	c.Assert(err, IsNil)
+	repo := New(&Config{
+		DeviceNonceURI: nonceURI,
+	}, "", nil)
+
+	_, err = repo.DeviceSession(serial.(*asserts.Serial), otherKey)
+	c.Check(err, ErrorMatches, "cannot sign device session request: device key does not match the one in the serial assertion")
+}
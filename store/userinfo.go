@@ -20,9 +20,17 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 )
 
 var (
@@ -41,10 +49,101 @@ type User struct {
 	OpenIDIdentifier string
 }
 
-func UserInfo(email string) (userinfo *User, err error) {
-	ssourl := fmt.Sprintf("%s/keys/%s", authURL(), url.QueryEscape(email))
+// KeyFingerprints returns the SHA256 fingerprints, in the format used
+// by ssh-keygen -l, of the user ssh keys. It returns an
+// *ErrMalformedSSHKey if any of them cannot be parsed.
+func (u *User) KeyFingerprints() ([]string, error) {
+	fingerprints := make([]string, len(u.SSHKeys))
+	for i, key := range u.SSHKeys {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return nil, &ErrMalformedSSHKey{Key: key, Err: err}
+		}
+		sum := sha256.Sum256(pubKey.Marshal())
+		fingerprints[i] = "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+	}
+	return fingerprints, nil
+}
+
+// AuthClient talks to an authentication service, it is the base for
+// targeting different stores from the same process.
+type AuthClient struct {
+	baseURL string
+
+	// base URL parsed once for building endpoint URLs
+	parsedBase *url.URL
+	parseErr   error
+}
+
+// NewAuthClient returns an AuthClient for the authentication service
+// at baseURL, "" means the default one, which can be set through the
+// SNAPPY_FORCE_SSO_URL environment variable.
+func NewAuthClient(baseURL string) *AuthClient {
+	ac := &AuthClient{baseURL: baseURL}
+	ac.parsedBase, ac.parseErr = parseBaseURL(ac.authURL())
+	return ac
+}
+
+// parseBaseURL parses base so that relative references resolve below
+// its path, whether it has a trailing slash or not.
+func parseBaseURL(base string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse authentication base URL %q: %v", base, err)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u, nil
+}
 
-	resp, err := httpClient.Get(ssourl)
+// endpointURL returns the URL of the endpoint at the path rel relative
+// to the base URL.
+func (ac *AuthClient) endpointURL(rel string) (*url.URL, error) {
+	if ac.parseErr != nil {
+		return nil, ac.parseErr
+	}
+	relURL, err := url.Parse(rel)
+	if err != nil {
+		return nil, err
+	}
+	return ac.parsedBase.ResolveReference(relURL), nil
+}
+
+func (ac *AuthClient) authURL() string {
+	if ac.baseURL != "" {
+		return ac.baseURL
+	}
+	return authURL()
+}
+
+// Ping checks that the authentication endpoint used by UserInfo is
+// reachable and responding.
+func (ac *AuthClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequest("HEAD", ac.authURL(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ctxhttp.Do(ctx, httpClient, req)
+	if err != nil {
+		return fmt.Errorf("cannot reach authentication endpoint: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return respToError(resp, "ping authentication endpoint")
+	}
+	return nil
+}
+
+// UserInfo retrieves the user information, including ssh keys, for
+// the account with the given email.
+func (ac *AuthClient) UserInfo(email string) (userinfo *User, err error) {
+	ssourl, err := ac.endpointURL("keys/" + url.QueryEscape(email))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Get(ssourl.String())
 	if err != nil {
 		return nil, err
 	}
@@ -62,3 +161,14 @@ func UserInfo(email string) (userinfo *User, err error) {
 		OpenIDIdentifier: v.OpenIDIdentifier,
 	}, nil
 }
+
+// Ping checks the default authentication endpoint, see AuthClient.Ping.
+func Ping(ctx context.Context) error {
+	return NewAuthClient("").Ping(ctx)
+}
+
+// UserInfo retrieves user information from the default
+// authentication service, see AuthClient.UserInfo.
+func UserInfo(email string) (userinfo *User, err error) {
+	return NewAuthClient("").UserInfo(email)
+}
@@ -25,7 +25,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"time"
 
+	"golang.org/x/net/context"
 	"gopkg.in/check.v1"
 
 	"github.com/snapcore/snapd/store"
@@ -79,3 +81,126 @@ func (s *userInfoSuite) TestCreateUser(c *check.C) {
 	c.Check(info.SSHKeys, check.DeepEquals, []string{"ssh-rsa AAAAB3NzaC1yc2EAAAABIwAAAIEAqwsTkky+laeukWyGFmtiAQUFgjD+wKYuRtOj11gjTe3qUNDgMR54W8IUELZ6NwNWs2wium+jQZLY4vlsDq4PkYK8J2qgjRZURCKp4JbjbVNSg2WO7vDtl+0FIC1GaCdglRVWffrwKN1RLlwqBCVXi01nnTk3+hEpWddjqoTXMwM= egon@top",
 		"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDKBFmfD1KNULZv35907+ArIfxdGGzF1XCQj287AgK7k5GWcEdnUQfkSUHRZ4cNOqshY6W3CyDzVAmaDmeB9A7qpmsVlQp2D8y253+F2NMm1bcDdT3weG5vxkdF5qdx99gRMwDYJ4WZgIryrCAOqDLKmoSEuyuh1Zil9pDGPh/grf+EgXzDFnntgE8XJVKIldsbUplCmycSNtk47PtJATJ8q5v2dIazlxwmxKfarXS7x805u4ElrZ2h3JMCOOfL1k3sJbYc4JbZ6zB8DAhSsZ79KrStn3DE+gULmPJjM0HEbtouegZpE5wcHldoo4Oi78uNrwtv1lWp4AnK/Xwm3bl/ egon@bod\r\n"})
 }
+
+func (s *userInfoSuite) TestPing(c *check.C) {
+	s.redirectToTestSSO(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, check.Equals, "HEAD")
+		c.Check(r.URL.Path, check.Equals, "/api/v2")
+		w.WriteHeader(404)
+	})
+
+	err := store.Ping(context.TODO())
+	c.Check(err, check.IsNil)
+}
+
+func (s *userInfoSuite) TestPingServerError(c *check.C) {
+	s.redirectToTestSSO(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	})
+
+	err := store.Ping(context.TODO())
+	c.Check(err, check.ErrorMatches, "cannot ping authentication endpoint: got unexpected HTTP status code 503 .*")
+}
+
+func (s *userInfoSuite) TestPingUnreachable(c *check.C) {
+	server := httptest.NewServer(nil)
+	server.Close()
+	os.Setenv("SNAPPY_FORCE_SSO_URL", server.URL+"/api/v2")
+	s.BaseTest.AddCleanup(func() { os.Unsetenv("SNAPPY_FORCE_SSO_URL") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := store.Ping(ctx)
+	c.Check(err, check.ErrorMatches, "cannot reach authentication endpoint: .*")
+}
+
+func (s *userInfoSuite) TestAuthClients(c *check.C) {
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			c.Check(r.URL.Path, check.Equals, "/api/v2")
+			return
+		}
+		c.Check(r.URL.Path, check.Equals, "/api/v2/keys/popper@lse.ac.uk")
+		fmt.Fprintln(w, `{"username": "user1"}`)
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			c.Check(r.URL.Path, check.Equals, "/other")
+			return
+		}
+		c.Check(r.URL.Path, check.Equals, "/other/keys/popper@lse.ac.uk")
+		fmt.Fprintln(w, `{"username": "user2"}`)
+	}))
+	defer server2.Close()
+
+	client1 := store.NewAuthClient(server1.URL + "/api/v2")
+	client2 := store.NewAuthClient(server2.URL + "/other")
+
+	info, err := client1.UserInfo("popper@lse.ac.uk")
+	c.Assert(err, check.IsNil)
+	c.Check(info.Username, check.Equals, "user1")
+
+	info, err = client2.UserInfo("popper@lse.ac.uk")
+	c.Assert(err, check.IsNil)
+	c.Check(info.Username, check.Equals, "user2")
+
+	c.Check(client1.Ping(context.TODO()), check.IsNil)
+	c.Check(client2.Ping(context.TODO()), check.IsNil)
+}
+
+func (s *userInfoSuite) TestKeyFingerprints(c *check.C) {
+	user := &store.User{
+		SSHKeys: []string{
+			"ssh-rsa AAAAB3NzaC1yc2EAAAABIwAAAIEAqwsTkky+laeukWyGFmtiAQUFgjD+wKYuRtOj11gjTe3qUNDgMR54W8IUELZ6NwNWs2wium+jQZLY4vlsDq4PkYK8J2qgjRZURCKp4JbjbVNSg2WO7vDtl+0FIC1GaCdglRVWffrwKN1RLlwqBCVXi01nnTk3+hEpWddjqoTXMwM= egon@top",
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAICbIEaWS44+d0zjfYq5TpzCpYLOvfjBbGkJawP8cCP14 user@host\r\n",
+		},
+	}
+
+	fingerprints, err := user.KeyFingerprints()
+	c.Assert(err, check.IsNil)
+	// as computed by ssh-keygen -l
+	c.Check(fingerprints, check.DeepEquals, []string{
+		"SHA256:eebBBFhzjzKFiWIAW1aII3a8kPskF0h/Es1Bek/CVW4",
+		"SHA256:coIMkyRAJz2QNQkVEQbx44pKNdOm1uB9ZVzj8mHeyj0",
+	})
+}
+
+func (s *userInfoSuite) TestKeyFingerprintsMalformed(c *check.C) {
+	user := &store.User{
+		SSHKeys: []string{
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAICbIEaWS44+d0zjfYq5TpzCpYLOvfjBbGkJawP8cCP14 user@host",
+			"ssh-rsa AAAAnot-a-key egon@top",
+		},
+	}
+
+	fingerprints, err := user.KeyFingerprints()
+	c.Check(fingerprints, check.IsNil)
+	c.Assert(err, check.FitsTypeOf, &store.ErrMalformedSSHKey{})
+	c.Check(err.(*store.ErrMalformedSSHKey).Key, check.Equals, "ssh-rsa AAAAnot-a-key egon@top")
+	c.Check(err, check.ErrorMatches, `cannot parse ssh key "ssh-rsa AAAAnot-a-key egon@top": .*`)
+}
+
+func (s *userInfoSuite) TestUserInfoBaseURLForms(c *check.C) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprintln(w, `{"username": "user1"}`)
+	}))
+	defer server.Close()
+
+	for _, base := range []string{server.URL + "/api/v2", server.URL + "/api/v2/"} {
+		info, err := store.NewAuthClient(base).UserInfo("popper@lse.ac.uk")
+		c.Assert(err, check.IsNil)
+		c.Check(info.Username, check.Equals, "user1")
+	}
+	c.Check(paths, check.DeepEquals, []string{
+		"/api/v2/keys/popper@lse.ac.uk",
+		"/api/v2/keys/popper@lse.ac.uk",
+	})
+}
+
+func (s *userInfoSuite) TestUserInfoInvalidBaseURL(c *check.C) {
+	_, err := store.NewAuthClient("http://[::1").UserInfo("popper@lse.ac.uk")
+	c.Check(err, check.ErrorMatches, `cannot parse authentication base URL "http://\[::1": .*`)
+}